@@ -0,0 +1,126 @@
+package smtpd
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// Credentials are the only username and password accepted when AUTH is
+// enforced.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// ParseCredentials parses a "username:password" flag value.
+func ParseCredentials(value string) (*Credentials, error) {
+	username, password, ok := strings.Cut(value, ":")
+	if !ok || username == "" {
+		return nil, fmt.Errorf("expected username:password, got %q", value)
+	}
+	return &Credentials{Username: username, Password: password}, nil
+}
+
+func (s *Session) AuthMechanisms() []string {
+	return []string{sasl.Plain, sasl.Login, "CRAM-MD5"}
+}
+
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return s.authenticate(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: s.authenticate}, nil
+	case "CRAM-MD5":
+		return &cramMD5Server{session: s}, nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// authenticate checks a username and password. Without configured
+// credentials any login succeeds, so the username can still be recorded.
+func (s *Session) authenticate(username, password string) error {
+	if s.credentials != nil {
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.credentials.Username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.credentials.Password)) == 1
+		if !userOK || !passOK {
+			return smtp.ErrAuthFailed
+		}
+	}
+	s.username = username
+	return nil
+}
+
+// loginServer implements the obsolete but widely used LOGIN mechanism,
+// which go-sasl only provides a client for.
+type loginServer struct {
+	authenticate func(username, password string) error
+	username     string
+	step         int
+}
+
+func (a *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		a.step++
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		// The client sent the username as an initial response
+		fallthrough
+	case 1:
+		a.username = string(response)
+		a.step = 2
+		return []byte("Password:"), false, nil
+	case 2:
+		a.step++
+		return nil, true, a.authenticate(a.username, string(response))
+	}
+	return nil, false, sasl.ErrUnexpectedClientResponse
+}
+
+// cramMD5Server implements CRAM-MD5 (RFC 2195). The password never crosses
+// the wire, so without configured credentials only the username is checked.
+type cramMD5Server struct {
+	session   *Session
+	challenge string
+	done      bool
+}
+
+func (a *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.challenge == "" {
+		a.challenge = fmt.Sprintf("<%s.%d@localhost>", NewID(), time.Now().UnixNano())
+		return []byte(a.challenge), false, nil
+	}
+	if a.done {
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+	a.done = true
+
+	username, digest, ok := strings.Cut(string(response), " ")
+	if !ok || username == "" {
+		return nil, true, smtp.ErrAuthFailed
+	}
+
+	if creds := a.session.credentials; creds != nil {
+		mac := hmac.New(md5.New, []byte(creds.Password))
+		mac.Write([]byte(a.challenge))
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if username != creds.Username || !hmac.Equal([]byte(strings.ToLower(digest)), []byte(expected)) {
+			return nil, true, smtp.ErrAuthFailed
+		}
+	}
+
+	a.session.username = username
+	return nil, true, nil
+}
@@ -0,0 +1,178 @@
+package smtpd
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/smtp"
+	"strconv"
+	"testing"
+
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected *Credentials
+	}{
+		{"user:secret", &Credentials{Username: "user", Password: "secret"}},
+		{"user:with:colon", &Credentials{Username: "user", Password: "with:colon"}},
+		{"user:", &Credentials{Username: "user", Password: ""}},
+		{"nopassword", nil},
+		{":secret", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			creds, err := ParseCredentials(tt.value)
+			if tt.expected == nil {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", creds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCredentials failed: %v", err)
+			}
+			if *creds != *tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, creds)
+			}
+		})
+	}
+}
+
+func TestLoginMechanism(t *testing.T) {
+	s := &Session{credentials: &Credentials{Username: "user", Password: "secret"}}
+
+	server, err := s.Auth("LOGIN")
+	if err != nil {
+		t.Fatalf("Auth failed: %v", err)
+	}
+	challenge, done, err := server.Next(nil)
+	if err != nil || done || string(challenge) != "Username:" {
+		t.Fatalf("Expected username challenge, got %q %v %v", challenge, done, err)
+	}
+	challenge, done, err = server.Next([]byte("user"))
+	if err != nil || done || string(challenge) != "Password:" {
+		t.Fatalf("Expected password challenge, got %q %v %v", challenge, done, err)
+	}
+	_, done, err = server.Next([]byte("secret"))
+	if err != nil || !done {
+		t.Fatalf("Expected successful login, got %v %v", done, err)
+	}
+	if s.username != "user" {
+		t.Errorf("Expected username to be recorded, got %q", s.username)
+	}
+}
+
+func TestLoginMechanismInitialResponse(t *testing.T) {
+	s := &Session{}
+
+	server, _ := s.Auth("LOGIN")
+	challenge, done, err := server.Next([]byte("anyone"))
+	if err != nil || done || string(challenge) != "Password:" {
+		t.Fatalf("Expected password challenge, got %q %v %v", challenge, done, err)
+	}
+	if _, done, err := server.Next([]byte("whatever")); err != nil || !done {
+		t.Fatalf("Expected any login to succeed without credentials, got %v %v", done, err)
+	}
+	if s.username != "anyone" {
+		t.Errorf("Expected username to be recorded, got %q", s.username)
+	}
+}
+
+func TestCRAMMD5Mechanism(t *testing.T) {
+	s := &Session{credentials: &Credentials{Username: "user", Password: "secret"}}
+
+	respond := func(password string) error {
+		server, _ := s.Auth("CRAM-MD5")
+		challenge, _, err := server.Next(nil)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(md5.New, []byte(password))
+		mac.Write(challenge)
+		_, _, err = server.Next([]byte("user " + hex.EncodeToString(mac.Sum(nil))))
+		return err
+	}
+
+	if err := respond("wrong"); !errors.Is(err, gosmtp.ErrAuthFailed) {
+		t.Errorf("Expected bad digest to fail, got %v", err)
+	}
+	if s.username != "" {
+		t.Errorf("Expected no username after failed login, got %q", s.username)
+	}
+	if err := respond("secret"); err != nil {
+		t.Errorf("Expected correct digest to succeed, got %v", err)
+	}
+	if s.username != "user" {
+		t.Errorf("Expected username to be recorded, got %q", s.username)
+	}
+}
+
+func TestUnknownMechanism(t *testing.T) {
+	s := &Session{}
+	if _, err := s.Auth("XOAUTH2"); err == nil {
+		t.Error("Expected unknown mechanism to be rejected")
+	}
+}
+
+func startAuthServer(t *testing.T, creds *Credentials) (*CaptureStore, string) {
+	t.Helper()
+	store := NewCaptureStore()
+	server := NewServer(freePort(t), store)
+	server.RequireAuth(creds)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(server.Stop)
+
+	return store, net.JoinHostPort("localhost", strconv.Itoa(server.Port()))
+}
+
+func dialClient(t *testing.T, addr string) *smtp.Client {
+	t.Helper()
+	conn := dialSMTP(t, addr, func() (net.Conn, error) { return net.Dial("tcp", addr) })
+	client, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestAuthRecordsUsername(t *testing.T) {
+	store, addr := startAuthServer(t, nil)
+
+	client := dialClient(t, addr)
+	if err := client.Auth(smtp.PlainAuth("", "mailer", "anything", "localhost")); err != nil {
+		t.Fatalf("AUTH PLAIN failed: %v", err)
+	}
+	sendTestMessage(t, client)
+
+	emails := store.Emails()
+	if len(emails) != 1 || emails[0].AuthUser != "mailer" {
+		t.Fatalf("Expected email authenticated as mailer, got %+v", emails)
+	}
+}
+
+func TestAuthEnforcement(t *testing.T) {
+	_, addr := startAuthServer(t, &Credentials{Username: "mailer", Password: "secret"})
+
+	client := dialClient(t, addr)
+	if err := client.Auth(smtp.PlainAuth("", "mailer", "wrong", "localhost")); err == nil {
+		t.Error("Expected bad password to be rejected")
+	}
+	if err := client.Mail("sender@example.com"); err == nil {
+		t.Error("Expected unauthenticated MAIL to be rejected")
+	}
+
+	client = dialClient(t, addr)
+	if err := client.Auth(smtp.CRAMMD5Auth("mailer", "secret")); err != nil {
+		t.Fatalf("AUTH CRAM-MD5 with correct credentials failed: %v", err)
+	}
+	sendTestMessage(t, client)
+}
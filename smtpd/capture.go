@@ -0,0 +1,37 @@
+package smtpd
+
+import "sync"
+
+// CaptureStore keeps the messages a server receives in memory and publishes
+// an event for each one. It suits tests and throwaway servers.
+type CaptureStore struct {
+	mu     sync.Mutex
+	emails []Email
+	events *Broadcaster
+}
+
+func NewCaptureStore() *CaptureStore {
+	return &CaptureStore{events: NewBroadcaster()}
+}
+
+func (m *CaptureStore) Save(email Email) error {
+	m.mu.Lock()
+	m.emails = append(m.emails, email)
+	m.mu.Unlock()
+
+	m.events.Publish(MessageEvent(email))
+	return nil
+}
+
+// Emails returns the saved messages, oldest first.
+func (m *CaptureStore) Emails() []Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Email(nil), m.emails...)
+}
+
+// Subscribe returns a subscription to the events of messages saved from now
+// on.
+func (m *CaptureStore) Subscribe() *Subscription {
+	return m.events.Subscribe()
+}
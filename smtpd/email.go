@@ -0,0 +1,211 @@
+package smtpd
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Email struct {
+	ID      string
+	From    string
+	To      string
+	Subject string
+	Body    string
+	Date    string
+	// Headers holds every header field; repeated fields keep all values.
+	Headers mail.Header
+	// Recipients holds every envelope RCPT TO address, in the order the
+	// client sent them. It may differ from the To/Cc headers.
+	Recipients []Recipient
+	// Parts holds the decoded leaf parts of the MIME tree.
+	Parts []Part
+	// Attachments describes the parts meant to be saved rather than read.
+	Attachments []Attachment
+	// Raw is the exact message received in DATA.
+	Raw []byte
+	// TLSVersion and TLSCipher describe the connection the message arrived
+	// on; both are empty when it was sent in plaintext.
+	TLSVersion string
+	TLSCipher  string
+	// AuthUser is the username the client authenticated as, if any.
+	AuthUser string
+}
+
+type Recipient struct {
+	Address string
+	Bcc     bool // true when the address does not appear in To or Cc
+}
+
+type Part struct {
+	Index       int
+	ContentType string // media type without parameters, e.g. "text/html"
+	Charset     string
+	Disposition string // "inline", "attachment" or empty
+	Filename    string
+	ContentID   string
+	Content     []byte // decoded; text parts are converted to UTF-8
+}
+
+type Attachment struct {
+	PartIndex   int // index into Email.Parts holding the content
+	Filename    string
+	ContentType string
+	Size        int
+	ContentID   string
+	Disposition string
+}
+
+// NewID returns a random message ID.
+func NewID() string {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = charset[rand.Intn(len(charset))]
+	}
+	return string(b)
+}
+
+func extractSubject(body string) string {
+	lines := strings.Split(body, "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(strings.ToLower(line), "subject:") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) > 1 {
+				return strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	return "(no subject)"
+}
+
+// ParseEmail builds an Email from a raw message and its SMTP envelope.
+func ParseEmail(rawEmail string, from string, to []string, id string) Email {
+	// Try to parse using net/mail
+	msg, err := mail.ReadMessage(strings.NewReader(rawEmail))
+
+	if err != nil {
+		// Fallback to simple parsing if net/mail fails
+		return Email{
+			ID:         id,
+			From:       from,
+			To:         strings.Join(to, ", "),
+			Subject:    extractSubject(rawEmail),
+			Body:       rawEmail,
+			Date:       time.Now().Format(time.RFC1123),
+			Headers:    make(mail.Header),
+			Recipients: envelopeRecipients(to, nil),
+			Raw:        []byte(rawEmail),
+		}
+	}
+
+	// Extract body content
+	bodyBytes, err := io.ReadAll(msg.Body)
+	if err != nil {
+		bodyBytes = []byte("Error reading body")
+	}
+	body := string(bodyBytes)
+	parts := parseMIME(textproto.MIMEHeader(msg.Header), strings.NewReader(body))
+
+	// Get subject from headers
+	subject := decodeHeaderWord(msg.Header.Get("Subject"))
+	if subject == "" {
+		subject = "(no subject)"
+	}
+
+	// Get date from headers, fallback to current time
+	date := time.Now().Format(time.RFC1123)
+	if dateHeader := msg.Header.Get("Date"); dateHeader != "" {
+		date = dateHeader
+	}
+
+	// Prefer the To header for display, falling back to the envelope
+	toHeader := msg.Header.Get("To")
+	if toHeader == "" {
+		toHeader = strings.Join(to, ", ")
+	}
+
+	return Email{
+		ID:          id,
+		From:        from,
+		To:          toHeader,
+		Subject:     subject,
+		Body:        body,
+		Date:        date,
+		Headers:     msg.Header,
+		Recipients:  envelopeRecipients(to, msg.Header),
+		Parts:       parts,
+		Attachments: attachmentsFromParts(parts),
+		Raw:         []byte(rawEmail),
+	}
+}
+
+// RecipientAddresses returns the envelope addresses of recipients.
+func RecipientAddresses(recipients []Recipient) []string {
+	addresses := make([]string, len(recipients))
+	for i, rcpt := range recipients {
+		addresses[i] = rcpt.Address
+	}
+	return addresses
+}
+
+// envelopeRecipients pairs each RCPT TO address with whether it was blind,
+// i.e. absent from the message's To and Cc headers. A header that does not
+// parse as an address list is searched as plain text instead, so one
+// malformed header does not turn every recipient into a blind copy.
+func envelopeRecipients(rcpts []string, header mail.Header) []Recipient {
+	visible := make(map[string]bool)
+	var unparsed []string
+	for _, key := range []string{"To", "Cc"} {
+		if header == nil || header.Get(key) == "" {
+			continue
+		}
+		addrs, err := header.AddressList(key)
+		if err != nil {
+			unparsed = append(unparsed, strings.ToLower(strings.Join(header[key], ",")))
+			continue
+		}
+		for _, addr := range addrs {
+			visible[strings.ToLower(addr.Address)] = true
+		}
+	}
+
+	recipients := make([]Recipient, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		address := strings.ToLower(rcpt)
+		shown := visible[address] || slices.ContainsFunc(unparsed, func(value string) bool {
+			return strings.Contains(value, address)
+		})
+		recipients = append(recipients, Recipient{
+			Address: rcpt,
+			Bcc:     header != nil && !shown,
+		})
+	}
+	return recipients
+}
+
+// RawSource returns the message as received, rebuilding it from the stored
+// headers and body for emails captured before raw storage existed.
+func RawSource(email Email) []byte {
+	if len(email.Raw) > 0 {
+		return email.Raw
+	}
+
+	var b strings.Builder
+	for name, values := range email.Headers {
+		for _, value := range values {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+		}
+	}
+	if len(email.Headers) == 0 {
+		fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", email.From, email.To, email.Subject, email.Date)
+	}
+	b.WriteString("\r\n")
+	b.WriteString(email.Body)
+	return []byte(b.String())
+}
@@ -0,0 +1,169 @@
+package smtpd
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventMessage = "message" // an email was saved
+	EventDelete  = "delete"  // an email was deleted
+	EventClear   = "clear"   // every email was deleted
+)
+
+// Event describes a change to the stored emails. For EventMessage it carries
+// the envelope, subject and size of the new email; EventDelete only has ID.
+type Event struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      []string  `json:"to,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Size    int       `json:"size,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// MessageEvent describes email being saved.
+func MessageEvent(email Email) Event {
+	return Event{
+		Type:    EventMessage,
+		ID:      email.ID,
+		From:    email.From,
+		To:      RecipientAddresses(email.Recipients),
+		Subject: email.Subject,
+		Size:    len(RawSource(email)),
+		Time:    time.Now(),
+	}
+}
+
+// MaxQueuedEvents is how many events a subscription queues for a reader
+// that does not keep up before it is dropped.
+const MaxQueuedEvents = 10000
+
+// Broadcaster delivers every published event to every subscriber, in
+// order. Publishing never blocks: each subscription queues the events its
+// reader has not consumed yet, up to MaxQueuedEvents. A nil Broadcaster
+// discards events.
+type Broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subscribers: map[*Subscription]struct{}{}}
+}
+
+// Subscription receives events published after it was created until it is
+// closed. A reader that falls more than MaxQueuedEvents behind, such as a
+// client that stays connected but stops reading, is dropped: the
+// subscription is closed as if by Close, so Events is closed and the reader
+// should subscribe again and reload what it keeps track of.
+type Subscription struct {
+	// Events is closed after Close.
+	Events <-chan Event
+
+	broadcaster *Broadcaster
+	events      chan Event
+	done        chan struct{}
+	closeOnce   sync.Once
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []Event
+	closed bool
+}
+
+// Subscribe starts receiving events. Subscribing to a nil Broadcaster
+// returns a subscription that is already closed.
+func (b *Broadcaster) Subscribe() *Subscription {
+	events := make(chan Event)
+	if b == nil {
+		close(events)
+		s := &Subscription{Events: events, done: make(chan struct{}), closed: true}
+		s.closeOnce.Do(func() { close(s.done) })
+		return s
+	}
+	s := &Subscription{
+		Events:      events,
+		broadcaster: b,
+		events:      events,
+		done:        make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	b.mu.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+
+	go s.deliver()
+	return s
+}
+
+func (b *Broadcaster) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		s.mu.Lock()
+		full := len(s.queue) >= MaxQueuedEvents
+		if !full {
+			s.queue = append(s.queue, event)
+		}
+		s.mu.Unlock()
+		if full {
+			delete(b.subscribers, s)
+			s.stop()
+			continue
+		}
+		s.cond.Signal()
+	}
+}
+
+// Close stops delivery; queued events are discarded.
+func (s *Subscription) Close() {
+	if s.broadcaster != nil {
+		s.broadcaster.mu.Lock()
+		delete(s.broadcaster.subscribers, s)
+		s.broadcaster.mu.Unlock()
+	}
+	s.stop()
+}
+
+// stop ends delivery once the subscription is no longer published to.
+func (s *Subscription) stop() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.queue = nil
+		s.mu.Unlock()
+		s.cond.Signal()
+		close(s.done)
+	})
+}
+
+// deliver hands queued events to the reader of Events one at a time.
+func (s *Subscription) deliver() {
+	defer close(s.events)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
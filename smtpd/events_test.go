@@ -0,0 +1,106 @@
+package smtpd
+
+import (
+	"testing"
+	"time"
+)
+
+func receiveEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case event := <-sub.Events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return Event{}
+	}
+}
+
+func TestBroadcasterDeliversEveryEventInOrder(t *testing.T) {
+	b := NewBroadcaster()
+	first := b.Subscribe()
+	defer first.Close()
+	second := b.Subscribe()
+	defer second.Close()
+
+	// Nobody reads while publishing, which must neither block nor drop
+	for i := 0; i < 500; i++ {
+		b.Publish(Event{Type: EventDelete, ID: string(rune('a' + i%26))})
+	}
+
+	for _, sub := range []*Subscription{first, second} {
+		for i := 0; i < 500; i++ {
+			if event := receiveEvent(t, sub); event.ID != string(rune('a'+i%26)) {
+				t.Fatalf("Event %d: expected ID %q, got %q", i, string(rune('a'+i%26)), event.ID)
+			}
+		}
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	b := NewBroadcaster()
+	sub := b.Subscribe()
+	b.Publish(Event{Type: EventClear})
+	sub.Close()
+	sub.Close()
+
+	select {
+	case _, ok := <-sub.Events:
+		if ok {
+			// A queued event may be delivered before the close is seen
+			if _, ok := <-sub.Events; ok {
+				t.Error("Expected Events to be closed")
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Events to close")
+	}
+
+	b.Publish(Event{Type: EventClear})
+	var nilBroadcaster *Broadcaster
+	nilBroadcaster.Publish(Event{Type: EventClear})
+}
+
+func TestNilBroadcaster(t *testing.T) {
+	var b *Broadcaster
+	b.Publish(Event{Type: EventClear})
+
+	sub := b.Subscribe()
+	if _, ok := <-sub.Events; ok {
+		t.Error("Expected the subscription to a nil Broadcaster to be closed")
+	}
+	sub.Close()
+}
+
+func TestBroadcasterDropsSlowSubscribers(t *testing.T) {
+	b := NewBroadcaster()
+	slow := b.Subscribe()
+	defer slow.Close()
+
+	for i := 0; i < MaxQueuedEvents+10; i++ {
+		b.Publish(Event{Type: EventClear})
+	}
+
+	deadline := time.After(5 * time.Second)
+	for received := 0; ; received++ {
+		select {
+		case _, ok := <-slow.Events:
+			if ok {
+				continue
+			}
+			if received > 1 {
+				t.Errorf("Expected the queued events to be discarded, got %d", received)
+			}
+		case <-deadline:
+			t.Fatal("Timed out waiting for the slow subscription to be closed")
+		}
+		break
+	}
+
+	sub := b.Subscribe()
+	defer sub.Close()
+	b.Publish(Event{Type: EventDelete, ID: "a"})
+	if event := receiveEvent(t, sub); event.ID != "a" {
+		t.Errorf("Expected later subscriptions to be served, got %+v", event)
+	}
+}
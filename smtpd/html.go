@@ -0,0 +1,473 @@
+package smtpd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ANSI styles used by the renderer; each pair turns a style on and off
+// without resetting the others.
+const (
+	ansiBold      = "\x1b[1m"
+	ansiBoldOff   = "\x1b[22m"
+	ansiItalic    = "\x1b[3m"
+	ansiItalicOff = "\x1b[23m"
+	ansiUnder     = "\x1b[4m"
+	ansiUnderOff  = "\x1b[24m"
+)
+
+// maxTableCellWidth is the widest cell rendered as an aligned column;
+// wider cells mean the table is used for layout.
+const maxTableCellWidth = 40
+
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// invisibleChars are used by email templates to pad preheader text.
+var invisibleChars = strings.NewReplacer("\u200b", "", "\u200c", "", "\u200d", "", "\ufeff", "", "\u034f", "", "\u00ad", "")
+
+// htmlToText renders HTML as plain text, for indexing and the API.
+func htmlToText(src string) string {
+	return renderHTML(src, false)
+}
+
+// renderHTML renders an HTML document for the terminal: block elements
+// become line breaks, lists get bullets or numbers, data tables are aligned
+// in columns and links become numbered footnotes. With styled set, bold,
+// italic and underlined text use ANSI escapes.
+func renderHTML(src string, styled bool) string {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return strings.TrimSpace(src)
+	}
+
+	var links []string
+	r := &htmlRenderer{styled: styled, links: &links}
+	r.render(doc)
+	text := strings.TrimRight(r.out.String(), " \n")
+
+	if len(links) > 0 {
+		var b strings.Builder
+		b.WriteString(text)
+		b.WriteString("\n")
+		for i, link := range links {
+			fmt.Fprintf(&b, "\n[%d] %s", i+1, link)
+		}
+		text = b.String()
+	}
+	return text
+}
+
+type htmlRenderer struct {
+	out    strings.Builder
+	styled bool
+	links  *[]string
+	// prefix is written at the start of every line, for list indentation
+	// and blockquotes.
+	prefix []string
+	// newlines is how many line breaks are owed before the next text, and
+	// owedDepth how much of prefix blank lines among them get.
+	newlines  int
+	owedDepth int
+	// space records whitespace owed before the next word.
+	space bool
+	// lineStart is true until something is written on the current line.
+	lineStart bool
+	pre       int
+	lists     []htmlList
+	// pending holds styles opened by elements nothing was written for yet.
+	pending []string
+}
+
+type htmlList struct {
+	ordered bool
+	n       int
+}
+
+func (r *htmlRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+		r.element(n)
+		return
+	case html.CommentNode:
+		return
+	}
+	r.children(n)
+}
+
+func (r *htmlRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+func (r *htmlRenderer) element(n *html.Node) {
+	if hidden(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Style, atom.Script, atom.Title, atom.Noscript, atom.Template, atom.Iframe, atom.Object:
+		return
+	case atom.Br:
+		r.owe(min(r.newlines+1, 2))
+	case atom.Hr:
+		r.block(1)
+		r.write(strings.Repeat("─", 40))
+		r.block(1)
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			r.text(" [image: " + alt + "] ")
+		}
+	case atom.A:
+		r.link(n)
+	case atom.B, atom.Strong, atom.Th:
+		r.styledChildren(n, ansiBold, ansiBoldOff)
+	case atom.I, atom.Em:
+		r.styledChildren(n, ansiItalic, ansiItalicOff)
+	case atom.U, atom.Ins:
+		r.styledChildren(n, ansiUnder, ansiUnderOff)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.block(2)
+		r.styledChildren(n, ansiBold, ansiBoldOff)
+		r.block(2)
+	case atom.P:
+		r.block(2)
+		r.children(n)
+		r.block(2)
+	case atom.Pre:
+		r.block(2)
+		r.pre++
+		r.children(n)
+		r.pre--
+		r.block(2)
+	case atom.Blockquote:
+		r.block(2)
+		r.prefix = append(r.prefix, "> ")
+		r.children(n)
+		r.prefix = r.prefix[:len(r.prefix)-1]
+		r.block(2)
+	case atom.Ul, atom.Ol:
+		r.list(n)
+	case atom.Li:
+		r.listItem(n)
+	case atom.Table:
+		r.table(n)
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav, atom.Main, atom.Aside,
+		atom.Address, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt, atom.Dd, atom.Form, atom.Fieldset,
+		atom.Tr, atom.Center, atom.Details, atom.Summary, atom.Caption:
+		r.block(1)
+		r.children(n)
+		r.block(1)
+	default:
+		r.children(n)
+	}
+}
+
+// hidden reports whether n is styled invisible, as preheader text in
+// email templates usually is.
+func hidden(n *html.Node) bool {
+	style := strings.ToLower(strings.ReplaceAll(attr(n, "style"), " ", ""))
+	return strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") ||
+		strings.Contains(style, "mso-hide:all") && strings.Contains(style, "max-height:0")
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// block requests at least count line breaks before the next text: 1 for a
+// new line, 2 for a blank line between paragraphs.
+func (r *htmlRenderer) block(count int) {
+	r.owe(max(r.newlines, count))
+}
+
+func (r *htmlRenderer) owe(count int) {
+	if r.out.Len() > 0 {
+		if r.newlines == 0 || len(r.prefix) < r.owedDepth {
+			r.owedDepth = len(r.prefix)
+		}
+		r.newlines = count
+	}
+	r.space = false
+}
+
+// flush writes owed line breaks and the line prefix.
+func (r *htmlRenderer) flush() {
+	if r.newlines > 0 {
+		blank := strings.TrimRight(strings.Join(r.prefix[:min(r.owedDepth, len(r.prefix))], ""), " ")
+		for i := 0; i < r.newlines; i++ {
+			r.out.WriteString("\n")
+			if i < r.newlines-1 {
+				r.out.WriteString(blank)
+			}
+		}
+		r.out.WriteString(strings.Join(r.prefix, ""))
+		r.newlines = 0
+		r.lineStart = true
+		r.space = false
+	} else if r.out.Len() == 0 && !r.lineStart {
+		r.out.WriteString(strings.Join(r.prefix, ""))
+		r.lineStart = true
+	}
+	if r.space && !r.lineStart {
+		r.out.WriteString(" ")
+	}
+	r.space = false
+}
+
+// write outputs s as is on the current line.
+func (r *htmlRenderer) write(s string) {
+	r.flush()
+	for _, on := range r.pending {
+		r.out.WriteString(on)
+	}
+	r.pending = r.pending[:0]
+	r.out.WriteString(s)
+	r.lineStart = false
+}
+
+func (r *htmlRenderer) text(s string) {
+	s = invisibleChars.Replace(s)
+
+	if r.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				r.newlines++
+			}
+			if line != "" {
+				r.write(line)
+			}
+		}
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			r.space = true
+		}
+		return
+	}
+	if first, _ := utf8.DecodeRuneInString(s); unicode.IsSpace(first) {
+		r.space = true
+	}
+	for i, word := range words {
+		if i > 0 {
+			r.space = true
+		}
+		r.write(word)
+	}
+	if last, _ := utf8.DecodeLastRuneInString(s); unicode.IsSpace(last) {
+		r.space = true
+	}
+}
+
+func (r *htmlRenderer) styledChildren(n *html.Node, on, off string) {
+	if !r.styled {
+		r.children(n)
+		return
+	}
+	// The style is opened by the next write, so that it never spans owed
+	// line breaks and empty elements leave no escapes behind
+	depth := len(r.pending)
+	r.pending = append(r.pending, on)
+	r.children(n)
+	if len(r.pending) > depth {
+		r.pending = r.pending[:depth]
+		return
+	}
+	r.out.WriteString(off)
+}
+
+// link renders the link text followed by a footnote number. Links whose
+// text already shows the address, and in-page anchors, get no footnote.
+func (r *htmlRenderer) link(n *html.Node) {
+	r.styledChildren(n, ansiUnder, ansiUnderOff)
+
+	href := strings.TrimSpace(attr(n, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return
+	}
+	text := strings.Join(strings.Fields(nodeText(n)), " ")
+	if text == href || "mailto:"+text == href || strings.TrimSuffix(href, "/") == strings.TrimSuffix(text, "/") {
+		return
+	}
+
+	*r.links = append(*r.links, href)
+	r.space = false
+	r.write(fmt.Sprintf("[%d]", len(*r.links)))
+}
+
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(nodeText(c))
+	}
+	return b.String()
+}
+
+func (r *htmlRenderer) list(n *html.Node) {
+	if len(r.lists) > 0 {
+		r.block(1)
+	} else {
+		r.block(2)
+	}
+	r.lists = append(r.lists, htmlList{ordered: n.DataAtom == atom.Ol})
+	r.children(n)
+	r.lists = r.lists[:len(r.lists)-1]
+	if len(r.lists) > 0 {
+		r.block(1)
+	} else {
+		r.block(2)
+	}
+}
+
+func (r *htmlRenderer) listItem(n *html.Node) {
+	marker := "• "
+	if len(r.lists) > 0 {
+		list := &r.lists[len(r.lists)-1]
+		list.n++
+		if list.ordered {
+			marker = fmt.Sprintf("%d. ", list.n)
+		}
+	}
+
+	r.block(1)
+	r.write(marker)
+	r.prefix = append(r.prefix, strings.Repeat(" ", utf8.RuneCountInString(marker)))
+	r.children(n)
+	r.prefix = r.prefix[:len(r.prefix)-1]
+	r.block(1)
+}
+
+// table aligns the cells of data tables in columns. Tables used for page
+// layout, with a single column or cells holding blocks of content, are
+// rendered as a sequence of blocks instead. Only cells without blocks are
+// rendered to measure them, so nested layout tables are rendered once.
+func (r *htmlRenderer) table(n *html.Node) {
+	linksBefore := len(*r.links)
+	var rows [][]string
+	layout := false
+rows:
+	for _, tr := range tableRows(n) {
+		var row []string
+		for c := tr.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || (c.DataAtom != atom.Td && c.DataAtom != atom.Th) || hidden(c) {
+				continue
+			}
+			if hasBlock(c) {
+				layout = true
+				break rows
+			}
+			cell := &htmlRenderer{styled: r.styled, links: r.links}
+			cell.element(c)
+			text := strings.TrimSpace(cell.out.String())
+			if strings.Contains(text, "\n") || visibleWidth(text) > maxTableCellWidth {
+				layout = true
+				break rows
+			}
+			row = append(row, text)
+		}
+		rows = append(rows, row)
+	}
+
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	if layout || columns < 2 {
+		*r.links = (*r.links)[:linksBefore]
+		r.block(1)
+		r.children(n)
+		r.block(1)
+		return
+	}
+
+	widths := make([]int, columns)
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], visibleWidth(cell))
+		}
+	}
+
+	r.block(2)
+	for _, row := range rows {
+		if len(strings.Join(row, "")) == 0 {
+			continue
+		}
+		var line strings.Builder
+		for i, cell := range row {
+			line.WriteString(cell)
+			if i < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-visibleWidth(cell)+2))
+			}
+		}
+		r.block(1)
+		r.write(strings.TrimRight(line.String(), " "))
+	}
+	r.block(2)
+}
+
+// hasBlock reports whether the visible content of n has elements that
+// start new lines.
+func hasBlock(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || hidden(c) {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Head, atom.Style, atom.Script, atom.Title, atom.Noscript, atom.Template, atom.Iframe, atom.Object:
+			continue
+		case atom.Br, atom.Hr, atom.P, atom.Pre, atom.Blockquote, atom.Ul, atom.Ol, atom.Li, atom.Table,
+			atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+			atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav, atom.Main, atom.Aside,
+			atom.Address, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt, atom.Dd, atom.Form, atom.Fieldset,
+			atom.Tr, atom.Center, atom.Details, atom.Summary, atom.Caption:
+			return true
+		}
+		if hasBlock(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// tableRows returns the rows of table, looking through thead, tbody and
+// tfoot but not into nested tables.
+func tableRows(table *html.Node) []*html.Node {
+	var rows []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.DataAtom {
+			case atom.Tr:
+				rows = append(rows, c)
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				walk(c)
+			}
+		}
+	}
+	walk(table)
+	return rows
+}
+
+func visibleWidth(s string) int {
+	return utf8.RuneCountInString(ansiPattern.ReplaceAllString(s, ""))
+}
@@ -0,0 +1,201 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+// passwordResetTemplate follows the usual table-based transactional layout,
+// with a hidden preheader and a call-to-action button.
+const passwordResetTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Reset your password</title>
+  <style type="text/css">
+    body { margin: 0; padding: 0; }
+    .button a { background: #4f46e5; color: #ffffff; }
+  </style>
+</head>
+<body style="background-color:#f4f4f5;">
+  <div style="display:none;font-size:1px;max-height:0;overflow:hidden;">
+    Use this link to reset your password. The link is only valid for 24 hours.&#847;&zwnj;&nbsp;&#847;&zwnj;&nbsp;
+  </div>
+  <table width="100%" cellpadding="0" cellspacing="0" role="presentation">
+    <tr>
+      <td align="center">
+        <table class="email-content" width="100%" cellpadding="0" cellspacing="0" role="presentation">
+          <tr>
+            <td class="email-masthead">
+              <a href="https://example.com" class="email-masthead_name">Acme&nbsp;Inc.</a>
+            </td>
+          </tr>
+          <tr>
+            <td class="email-body" width="570">
+              <h1>Hi Jane,</h1>
+              <p>You recently requested to reset your password for your Acme account. Use the button below to reset it. <strong>This password reset is only valid for the next 24 hours.</strong></p>
+              <table class="body-action" align="center" width="100%" cellpadding="0" cellspacing="0" role="presentation">
+                <tr>
+                  <td align="center">
+                    <a href="https://example.com/reset?token=abc123&amp;u=42" class="button" target="_blank">Reset your password</a>
+                  </td>
+                </tr>
+              </table>
+              <p>For security, this request was received from a <em>Linux</em> device using Firefox. If you did not request a password reset, please ignore this email or <a href="mailto:support@example.com">contact support</a>.</p>
+              <p>Thanks,<br>The Acme team</p>
+            </td>
+          </tr>
+          <tr>
+            <td>
+              <p class="f-fallback sub">&copy; 2026 Acme Inc. All rights reserved.<br>1234 Street Rd. &mdash; Suite 1234</p>
+            </td>
+          </tr>
+        </table>
+      </td>
+    </tr>
+  </table>
+</body>
+</html>`
+
+// receiptTemplate lists purchased items in a data table.
+const receiptTemplate = `<html><body>
+<table role="presentation" width="100%"><tr><td>
+  <h2>Receipt for your order #1042</h2>
+  <p>Thanks for using Acme. This email is the receipt for your purchase.</p>
+  <table class="purchase" width="100%" cellpadding="0" cellspacing="0">
+    <thead>
+      <tr><th align="left">Description</th><th align="right">Amount</th></tr>
+    </thead>
+    <tbody>
+      <tr><td>Pro plan (monthly)</td><td align="right">&euro;12.00</td></tr>
+      <tr><td>Extra seats &times; 3</td><td align="right">&euro;9.00</td></tr>
+      <tr><td><strong>Total</strong></td><td align="right"><strong>&euro;21.00</strong></td></tr>
+    </tbody>
+  </table>
+  <p>What's included:</p>
+  <ul>
+    <li>Unlimited projects</li>
+    <li>Priority support
+      <ol><li>Email</li><li>Chat</li></ol>
+    </li>
+  </ul>
+  <blockquote>Questions? Reply to this email.</blockquote>
+  <p><a href="https://example.com/invoices/1042.pdf"><img src="cid:logo" alt="Download PDF"></a></p>
+</td></tr></table>
+</body></html>`
+
+func TestRenderPasswordResetTemplate(t *testing.T) {
+	want := `Acme Inc.[1]
+
+Hi Jane,
+
+You recently requested to reset your password for your Acme account. Use the button below to reset it. This password reset is only valid for the next 24 hours.
+
+Reset your password[2]
+
+For security, this request was received from a Linux device using Firefox. If you did not request a password reset, please ignore this email or contact support[3].
+
+Thanks,
+The Acme team
+
+© 2026 Acme Inc. All rights reserved.
+1234 Street Rd. — Suite 1234
+
+[1] https://example.com
+[2] https://example.com/reset?token=abc123&u=42
+[3] mailto:support@example.com`
+
+	if got := renderHTML(passwordResetTemplate, false); got != want {
+		t.Errorf("Unexpected rendering:\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderReceiptTemplate(t *testing.T) {
+	want := `Receipt for your order #1042
+
+Thanks for using Acme. This email is the receipt for your purchase.
+
+Description         Amount
+Pro plan (monthly)  €12.00
+Extra seats × 3     €9.00
+Total               €21.00
+
+What's included:
+
+• Unlimited projects
+• Priority support
+  1. Email
+  2. Chat
+
+> Questions? Reply to this email.
+
+[image: Download PDF][1]
+
+[1] https://example.com/invoices/1042.pdf`
+
+	if got := renderHTML(receiptTemplate, false); got != want {
+		t.Errorf("Unexpected rendering:\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderHTMLStyles(t *testing.T) {
+	got := renderHTML(receiptTemplate, true)
+	for _, want := range []string{
+		"\x1b[1mReceipt for your order #1042\x1b[22m\n",
+		"\x1b[1mDescription\x1b[22m         \x1b[1mAmount\x1b[22m\n",
+		"\x1b[1mTotal\x1b[22m               \x1b[1m€21.00\x1b[22m\n",
+		"\x1b[4m[image: Download PDF]\x1b[24m[1]",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in styled rendering, got %q", want, got)
+		}
+	}
+
+	for html, want := range map[string]string{
+		"<p><b></b>plain <b><i>both</i></b></p>": "plain \x1b[1m\x1b[3mboth\x1b[23m\x1b[22m",
+		"<blockquote><b>quoted</b></blockquote>": "> \x1b[1mquoted\x1b[22m",
+		"<b>one<br>two</b>":                      "\x1b[1mone\ntwo\x1b[22m",
+	} {
+		if got := renderHTML(html, true); got != want {
+			t.Errorf("renderHTML(%q) = %q, want %q", html, got, want)
+		}
+	}
+
+	if plain := renderHTML(receiptTemplate, false); strings.Contains(plain, "\x1b") {
+		t.Errorf("Expected no escapes in plain rendering, got %q", plain)
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"entities", "<p>Don&#8217;t wait &hellip; &lt;now&gt; &quot;ok&quot; &#x1F680;</p>", "Don’t wait … <now> \"ok\" 🚀"},
+		{"whitespace", "<div>\n  Hello,\n  <b>world</b>  !\n</div>", "Hello, world !"},
+		{"inline elements", "<p>a<span>b</span> <i>c</i></p>", "ab c"},
+		{"line breaks", "one<br>two<br><br><br>three", "one\ntwo\n\nthree"},
+		{"paragraphs", "<p>one</p><p>two</p><div>three</div><div>four</div>", "one\n\ntwo\n\nthree\nfour"},
+		{"pre", "<p>Code:</p><pre>  if x {\n    y()\n  }</pre>", "Code:\n\n  if x {\n    y()\n  }"},
+		{"rule", "above<hr>below", "above\n" + strings.Repeat("─", 40) + "\nbelow"},
+		{"link showing its address", `<a href="https://example.com/">https://example.com</a>`, "https://example.com"},
+		{"anchor link", `<a href="#top">Back to top</a>`, "Back to top"},
+		{"repeated links", `<a href="https://a.test">A</a> and <a href="https://b.test">B</a>`, "A[1] and B[2]\n\n[1] https://a.test\n[2] https://b.test"},
+		{"image without alt", `<img src="https://example.com/pixel.gif">Tracked`, "Tracked"},
+		{"hidden preheader", `<span style="display: none">Preview text</span><p>Body</p>`, "Body"},
+		{"zero width padding", "<p>Hi\u200c\u034f there</p>", "Hi there"},
+		{"ordered list", "<ol><li>First</li><li>Second</li></ol>", "1. First\n2. Second"},
+		{"layout table", `<table><tr><td><p>Header</p></td></tr><tr><td><p>Content</p></td></tr></table>`, "Header\n\nContent"},
+		{"nested layout tables", strings.Repeat("<table><tr><td>", 64) + "<p>Deep</p>" + strings.Repeat("</td></tr></table>", 64), "Deep"},
+		{"fragment", "Plain text", "Plain text"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderHTML(tt.html, false); got != tt.want {
+				t.Errorf("renderHTML(%q) = %q, want %q", tt.html, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxMIMEDepth bounds how deeply nested multiparts are followed, so a
+// malicious message cannot exhaust the stack.
+const maxMIMEDepth = 16
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// parseMIME walks the MIME tree of a message and returns its leaf parts in
+// depth-first order, with transfer encodings removed and text converted to
+// UTF-8.
+func parseMIME(header textproto.MIMEHeader, body io.Reader) []Part {
+	var parts []Part
+	walkMIME(header, body, 0, &parts)
+	for i := range parts {
+		parts[i].Index = i
+	}
+	return parts
+}
+
+func walkMIME(header textproto.MIMEHeader, body io.Reader, depth int, parts *[]Part) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxMIMEDepth {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				// io.EOF ends the multipart; anything else is a
+				// truncated message, so keep what was parsed so far
+				return
+			}
+			walkMIME(p.Header, p, depth+1, parts)
+		}
+	}
+
+	content, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil && len(content) == 0 {
+		return
+	}
+
+	part := Part{
+		ContentType: mediaType,
+		ContentID:   strings.Trim(header.Get("Content-ID"), "<> "),
+		Content:     content,
+	}
+
+	if disposition, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Disposition = disposition
+		part.Filename = decodeHeaderWord(dparams["filename"])
+	}
+	if part.Filename == "" {
+		part.Filename = decodeHeaderWord(params["name"])
+	}
+
+	if strings.HasPrefix(mediaType, "text/") {
+		part.Charset = strings.ToLower(params["charset"])
+		part.Content = decodeCharset(part.Charset, content)
+	}
+
+	*parts = append(*parts, part)
+}
+
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// base64Cleaner strips line breaks and other whitespace that mailers insert
+// into base64 bodies, which encoding/base64 would otherwise reject.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	out := 0
+	for _, b := range p[:n] {
+		switch b {
+		case '\r', '\n', ' ', '\t':
+			continue
+		}
+		p[out] = b
+		out++
+	}
+	return out, err
+}
+
+func decodeCharset(charset string, content []byte) []byte {
+	switch charset {
+	case "", "utf-8", "us-ascii":
+		return content
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return content
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return content
+	}
+	return decoded
+}
+
+// decodeHeaderWord decodes RFC 2047 encoded-words, returning the input
+// unchanged when it is not encoded or cannot be decoded.
+func decodeHeaderWord(s string) string {
+	decoded, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// IsAttachment reports whether the part is meant to be saved rather than
+// displayed as the message body.
+func (p Part) IsAttachment() bool {
+	if p.Disposition == "attachment" {
+		return true
+	}
+	return p.Filename != "" && !strings.HasPrefix(p.ContentType, "text/")
+}
+
+// attachmentsFromParts lists the attachments and inline resources (such as
+// cid: images) among the parts of a message.
+func attachmentsFromParts(parts []Part) []Attachment {
+	var attachments []Attachment
+	for _, part := range parts {
+		inline := part.ContentID != "" && !strings.HasPrefix(part.ContentType, "text/")
+		if !part.IsAttachment() && !inline {
+			continue
+		}
+		attachments = append(attachments, Attachment{
+			PartIndex:   part.Index,
+			Filename:    part.Filename,
+			ContentType: part.ContentType,
+			Size:        len(part.Content),
+			ContentID:   part.ContentID,
+			Disposition: part.Disposition,
+		})
+	}
+	return attachments
+}
+
+// AttachmentContent returns the decoded bytes of an attachment.
+func (e Email) AttachmentContent(a Attachment) []byte {
+	if a.PartIndex < 0 || a.PartIndex >= len(e.Parts) {
+		return nil
+	}
+	return e.Parts[a.PartIndex].Content
+}
+
+// BodyPart returns the first part of contentType that is not an attachment.
+func (e Email) BodyPart(contentType string) (Part, bool) {
+	for _, part := range e.Parts {
+		if part.ContentType == contentType && !part.IsAttachment() {
+			return part, true
+		}
+	}
+	return Part{}, false
+}
+
+// TextBody returns the plain text alternative of the message, rendering the
+// HTML alternative when no plain text part exists.
+func (e Email) TextBody() string {
+	if part, ok := e.BodyPart("text/plain"); ok {
+		return string(part.Content)
+	}
+	if part, ok := e.BodyPart("text/html"); ok {
+		return htmlToText(string(part.Content))
+	}
+	return htmlToText(e.Body)
+}
+
+// TerminalBody is TextBody for display in the terminal, with the HTML
+// alternative rendered using ANSI bold, italic and underline.
+func (e Email) TerminalBody() string {
+	if part, ok := e.BodyPart("text/plain"); ok {
+		return string(part.Content)
+	}
+	if part, ok := e.BodyPart("text/html"); ok {
+		return renderHTML(string(part.Content), true)
+	}
+	return renderHTML(e.Body, true)
+}
+
+// HTMLBody returns the HTML alternative of the message, falling back to the
+// plain text part when the message has no HTML.
+func (e Email) HTMLBody() string {
+	if part, ok := e.BodyPart("text/html"); ok {
+		return string(part.Content)
+	}
+	if part, ok := e.BodyPart("text/plain"); ok {
+		return string(part.Content)
+	}
+	return e.Body
+}
@@ -0,0 +1,120 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+const multipartEmail = "From: sender@example.com\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Subject: =?UTF-8?B?SW52b2ljZSDwn5OE?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Hello caf=C3=A9, your invoice is attached.=\r\n" +
+	" Thanks!\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+SGVsbG8gY2Fm6SwgeW91ciBpbnZvaWNlIGlzIGF0dGFj\r\n" +
+	"aGVkLjwvcD4=\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"invoice.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--outer--\r\n"
+
+func TestParseMIMEMultipart(t *testing.T) {
+	email := ParseEmail(multipartEmail, "sender@example.com", []string{"recipient@example.com"}, "mime1")
+
+	if email.Subject != "Invoice 📄" {
+		t.Errorf("Expected decoded subject, got %q", email.Subject)
+	}
+	if len(email.Parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d", len(email.Parts))
+	}
+
+	expected := []struct {
+		contentType string
+		content     string
+		attachment  bool
+	}{
+		{"text/plain", "Hello café, your invoice is attached. Thanks!", false},
+		{"text/html", "<p>Hello café, your invoice is attached.</p>", false},
+		{"application/pdf", "%PDF-1.4\n", true},
+	}
+	for i, want := range expected {
+		part := email.Parts[i]
+		if part.Index != i {
+			t.Errorf("Part %d: expected index %d, got %d", i, i, part.Index)
+		}
+		if part.ContentType != want.contentType {
+			t.Errorf("Part %d: expected content type %q, got %q", i, want.contentType, part.ContentType)
+		}
+		if string(part.Content) != want.content {
+			t.Errorf("Part %d: expected content %q, got %q", i, want.content, part.Content)
+		}
+		if part.IsAttachment() != want.attachment {
+			t.Errorf("Part %d: expected attachment %v", i, want.attachment)
+		}
+	}
+	if email.Parts[2].Filename != "invoice.pdf" {
+		t.Errorf("Expected attachment filename, got %q", email.Parts[2].Filename)
+	}
+
+	if !strings.HasPrefix(email.TextBody(), "Hello café") {
+		t.Errorf("Expected plain text alternative, got %q", email.TextBody())
+	}
+	if !strings.HasPrefix(email.HTMLBody(), "<p>") {
+		t.Errorf("Expected HTML alternative, got %q", email.HTMLBody())
+	}
+}
+
+func TestParseMIMESinglePart(t *testing.T) {
+	raw := "From: a@example.com\r\n" +
+		"Subject: Plain\r\n" +
+		"\r\n" +
+		"Just text\r\n"
+
+	email := ParseEmail(raw, "a@example.com", []string{"b@example.com"}, "mime2")
+	if len(email.Parts) != 1 {
+		t.Fatalf("Expected 1 part, got %d", len(email.Parts))
+	}
+	if email.Parts[0].ContentType != "text/plain" {
+		t.Errorf("Expected default text/plain, got %q", email.Parts[0].ContentType)
+	}
+	if email.TextBody() != "Just text\r\n" {
+		t.Errorf("Unexpected text body %q", email.TextBody())
+	}
+	if email.HTMLBody() != "Just text\r\n" {
+		t.Errorf("Expected HTML body to fall back to text, got %q", email.HTMLBody())
+	}
+}
+
+func TestHTMLOnlyTextBody(t *testing.T) {
+	email := Email{Parts: []Part{{ContentType: "text/html", Content: []byte("<p>Reset &amp; go</p>")}}}
+	if email.TextBody() != "Reset & go" {
+		t.Errorf("Expected rendered HTML, got %q", email.TextBody())
+	}
+}
+
+func TestLegacyEmailWithoutParts(t *testing.T) {
+	email := Email{Body: "<b>old</b>"}
+	if email.TextBody() != "old" {
+		t.Errorf("Expected legacy body rendered as text, got %q", email.TextBody())
+	}
+	if email.HTMLBody() != "<b>old</b>" {
+		t.Errorf("Expected legacy body as HTML, got %q", email.HTMLBody())
+	}
+}
@@ -0,0 +1,392 @@
+// Package smtpd is lazySMTP's capturing SMTP server: it accepts every
+// message, parses it into an Email and hands it to a Store.
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// maxPortFallback is how many ports after the configured one are tried when
+// port fallback is enabled.
+const maxPortFallback = 10
+
+// Store keeps the messages the server accepts. Save is called from the
+// connection goroutines, so it must be safe for concurrent use.
+type Store interface {
+	Save(email Email) error
+}
+
+type Backend struct {
+	store       Store
+	credentials *Credentials
+	logger      *slog.Logger
+}
+
+func NewBackend(store Store) *Backend {
+	return &Backend{store: store}
+}
+
+func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &Session{store: bkd.store, conn: c, credentials: bkd.credentials, logger: bkd.logger}, nil
+}
+
+type Session struct {
+	store       Store
+	conn        *smtp.Conn
+	credentials *Credentials
+	logger      *slog.Logger
+	username    string
+	from        string
+	to          []string
+	body        strings.Builder
+}
+
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.credentials != nil && s.username == "" {
+		return smtp.ErrAuthRequired
+	}
+	s.from = from
+	return nil
+}
+
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *Session) Data(r io.Reader) error {
+	_, err := io.Copy(&s.body, r)
+	if err != nil {
+		return err
+	}
+
+	id := NewID()
+	email := ParseEmail(s.body.String(), s.from, s.to, id)
+	email.AuthUser = s.username
+	if s.conn != nil {
+		if state, ok := s.conn.TLSConnectionState(); ok {
+			email.TLSVersion = tls.VersionName(state.Version)
+			email.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+		}
+	}
+
+	if err := s.store.Save(email); err != nil {
+		if s.logger != nil {
+			s.logger.Error("failed to save message", "id", id, "error", err)
+		}
+		// A temporary failure makes the client keep the message and retry
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to store message, try again later",
+		}
+	}
+	if s.logger != nil {
+		s.logger.Info("message received",
+			"id", email.ID,
+			"from", email.From,
+			"recipients", RecipientAddresses(email.Recipients),
+			"subject", email.Subject,
+			"size", len(email.Raw),
+			"tls", email.TLSVersion,
+			"auth_user", email.AuthUser,
+		)
+	}
+	return nil
+}
+
+func (s *Session) Reset() {
+	s.from = ""
+	s.to = nil
+	s.body.Reset()
+}
+
+func (s *Session) Logout() error {
+	return nil
+}
+
+// DefaultMaxMessageBytes is the largest message a Server accepts unless
+// SetMaxMessageBytes changes it.
+const DefaultMaxMessageBytes = 1024 * 1024
+
+type Server struct {
+	server    *smtp.Server
+	tlsServer *smtp.Server
+	listeners []net.Listener
+	port      int
+	tlsPort   int
+	tlsConfig *tls.Config
+	starttls  bool
+	auth      *Credentials
+	logger    *slog.Logger
+	store     Store
+	host      string
+	maxBytes  int64
+	running   bool
+	fallback  bool
+	err       error
+}
+
+func NewServer(port int, store Store) *Server {
+	return &Server{
+		port:     port,
+		store:    store,
+		maxBytes: DefaultMaxMessageBytes,
+	}
+}
+
+// EnableTLS configures encryption using config: starttls offers STARTTLS on
+// the main port, and a non-zero implicitPort also listens there for implicit
+// TLS (SMTPS). It takes effect on the next Start.
+func (s *Server) EnableTLS(config *tls.Config, starttls bool, implicitPort int) {
+	s.tlsConfig = config
+	s.starttls = starttls
+	s.tlsPort = implicitPort
+}
+
+// RequireAuth makes the server reject clients that do not authenticate with
+// creds. With nil creds any login is accepted. It takes effect on the next
+// Start.
+func (s *Server) RequireAuth(creds *Credentials) {
+	s.auth = creds
+}
+
+// AuthRequired returns the enforced credentials, or nil when any login is
+// accepted.
+func (s *Server) AuthRequired() *Credentials {
+	return s.auth
+}
+
+// SetLogger makes the server log connection errors and received messages.
+// Without a logger nothing is printed, which keeps the TUI clean.
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+// SetHost restricts the listeners to host, e.g. "127.0.0.1"; by default
+// every interface is used. It takes effect on the next Start.
+func (s *Server) SetHost(host string) {
+	s.host = host
+}
+
+// SetMaxMessageBytes makes the server refuse larger messages with a
+// permanent 552 reply. It takes effect on the next Start.
+func (s *Server) SetMaxMessageBytes(n int64) {
+	s.maxBytes = n
+}
+
+// EnablePortFallback makes Start try the following ports when the
+// configured one is already in use. Port reports the port actually bound.
+func (s *Server) EnablePortFallback(enabled bool) {
+	s.fallback = enabled
+}
+
+func (s *Server) newServer(backend smtp.Backend, port int, tlsConfig *tls.Config) *smtp.Server {
+	server := smtp.NewServer(backend)
+	server.Addr = net.JoinHostPort(s.host, strconv.Itoa(port))
+	server.Domain = "localhost"
+	server.ReadTimeout = 10 * time.Second
+	server.WriteTimeout = 10 * time.Second
+	server.MaxMessageBytes = s.maxBytes
+	server.MaxRecipients = 50
+	server.AllowInsecureAuth = true
+	server.TLSConfig = tlsConfig
+	server.ErrorLog = errorLogger{s.logger}
+	return server
+}
+
+// errorLogger adapts go-smtp's error log to slog, discarding output when no
+// logger is configured.
+type errorLogger struct {
+	logger *slog.Logger
+}
+
+func (l errorLogger) Printf(format string, v ...interface{}) {
+	if l.logger != nil {
+		l.logger.Warn(strings.TrimSpace(fmt.Sprintf(format, v...)))
+	}
+}
+
+func (l errorLogger) Println(v ...interface{}) {
+	if l.logger != nil {
+		l.logger.Warn(strings.TrimSpace(fmt.Sprintln(v...)))
+	}
+}
+
+func (s *Server) Start() error {
+	if s.running {
+		return nil
+	}
+
+	backend := NewBackend(s.store)
+	backend.credentials = s.auth
+	backend.logger = s.logger
+
+	var starttlsConfig *tls.Config
+	if s.starttls {
+		starttlsConfig = s.tlsConfig
+	}
+
+	// Bind before returning so that a port already in use is reported to
+	// the caller instead of being lost in the serving goroutine
+	listener, err := s.listen()
+	if err != nil {
+		s.err = err
+		return err
+	}
+	server := s.newServer(backend, s.port, starttlsConfig)
+
+	var tlsServer *smtp.Server
+	var tlsListener net.Listener
+	if s.tlsConfig != nil && s.tlsPort != 0 {
+		tlsServer = s.newServer(backend, s.tlsPort, s.tlsConfig)
+		tlsListener, err = tls.Listen("tcp", tlsServer.Addr, s.tlsConfig)
+		if err != nil {
+			listener.Close()
+			s.err = err
+			return err
+		}
+	}
+
+	s.server = server
+	s.listeners = []net.Listener{listener}
+	go server.Serve(listener)
+
+	s.tlsServer = tlsServer
+	if tlsServer != nil {
+		s.listeners = append(s.listeners, tlsListener)
+		go tlsServer.Serve(tlsListener)
+	}
+
+	s.running = true
+	s.err = nil
+	return nil
+}
+
+// listen binds the SMTP port, moving on to the next ports while they are in
+// use if fallback is enabled.
+func (s *Server) listen() (net.Listener, error) {
+	port := s.port
+	for attempt := 0; ; attempt++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(s.host, strconv.Itoa(port)))
+		if err == nil {
+			// Port 0 picks a free port
+			s.port = listener.Addr().(*net.TCPAddr).Port
+			return listener, nil
+		}
+		if !s.fallback || attempt == maxPortFallback || !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+		port++
+	}
+}
+
+// Err returns why the last Start failed, or nil if it succeeded.
+func (s *Server) Err() error {
+	return s.err
+}
+
+// ListenErrorReason describes a bind failure in a few words for the TUI.
+func ListenErrorReason(err error) string {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return "address in use"
+	case errors.Is(err, syscall.EACCES):
+		return "permission denied"
+	}
+	return err.Error()
+}
+
+// closeListeners closes the bound listeners directly, since go-smtp only
+// tracks a listener once its Serve goroutine has started.
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+}
+
+func (s *Server) Stop() {
+	if s.server != nil && s.running {
+		s.closeListeners()
+		s.server.Close()
+		if s.tlsServer != nil {
+			s.tlsServer.Close()
+			s.tlsServer = nil
+		}
+		s.running = false
+	}
+}
+
+// Shutdown stops accepting connections and waits for open sessions to end,
+// or for ctx to expire.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.server == nil || !s.running {
+		return nil
+	}
+	s.running = false
+	s.closeListeners()
+
+	// go-smtp closes the listeners again; that error is expected
+	err := s.server.Shutdown(ctx)
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	if s.tlsServer != nil {
+		if tlsErr := s.tlsServer.Shutdown(ctx); err == nil && !errors.Is(tlsErr, net.ErrClosed) {
+			err = tlsErr
+		}
+		s.tlsServer = nil
+	}
+	return err
+}
+
+func (s *Server) IsRunning() bool {
+	return s.running
+}
+
+func (s *Server) Port() int {
+	return s.port
+}
+
+// Addr returns the host and port clients can connect to.
+func (s *Server) Addr() string {
+	host := s.host
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(s.port))
+}
+
+// TLSPort returns the implicit TLS port, or 0 when SMTPS is disabled.
+func (s *Server) TLSPort() int {
+	if s.tlsConfig == nil {
+		return 0
+	}
+	return s.tlsPort
+}
+
+// STARTTLS reports whether STARTTLS is offered on the main port.
+func (s *Server) STARTTLS() bool {
+	return s.tlsConfig != nil && s.starttls
+}
+
+func (s *Server) Toggle() error {
+	if s.IsRunning() {
+		s.Stop()
+		return nil
+	}
+	return s.Start()
+}
@@ -0,0 +1,262 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewID(t *testing.T) {
+	id := NewID()
+	if len(id) != 8 {
+		t.Errorf("Expected ID length 8, got %d", len(id))
+	}
+
+	id2 := NewID()
+	if id == id2 {
+		t.Error("Generated IDs should be unique")
+	}
+}
+
+func TestExtractSubject(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "subject present",
+			body:     "Subject: Test Email\nBody content",
+			expected: "Test Email",
+		},
+		{
+			name:     "subject with colon case insensitive",
+			body:     "subject: Lowercase subject\nBody",
+			expected: "Lowercase subject",
+		},
+		{
+			name:     "no subject",
+			body:     "Body content\nMore body",
+			expected: "(no subject)",
+		},
+		{
+			name:     "subject in middle",
+			body:     "Headers\nSubject: Middle\nBody",
+			expected: "Middle",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := extractSubject(tt.body)
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestParseEmailRecipients(t *testing.T) {
+	raw := "From: sender@example.com\r\n" +
+		"To: Alice <alice@example.com>\r\n" +
+		"Cc: bob@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Body\r\n"
+
+	email := ParseEmail(raw, "sender@example.com", []string{"alice@example.com", "Bob@example.com", "carol@example.com"}, "id1")
+
+	if email.To != "Alice <alice@example.com>" {
+		t.Errorf("Expected To header, got %q", email.To)
+	}
+	if len(email.Recipients) != 3 {
+		t.Fatalf("Expected 3 envelope recipients, got %d", len(email.Recipients))
+	}
+
+	expected := []Recipient{
+		{Address: "alice@example.com", Bcc: false},
+		{Address: "Bob@example.com", Bcc: false},
+		{Address: "carol@example.com", Bcc: true},
+	}
+	for i, rcpt := range expected {
+		if email.Recipients[i] != rcpt {
+			t.Errorf("Recipient %d: expected %+v, got %+v", i, rcpt, email.Recipients[i])
+		}
+	}
+
+	// A malformed Cc still shows the addresses it contains
+	raw = "To: alice@example.com\r\nCc: Bob <bob@example.com>, <broken\r\n\r\nBody\r\n"
+	email = ParseEmail(raw, "sender@example.com", []string{"alice@example.com", "bob@example.com", "carol@example.com"}, "id2")
+	for i, bcc := range []bool{false, false, true} {
+		if email.Recipients[i].Bcc != bcc {
+			t.Errorf("Recipient %d: expected Bcc %v with a malformed Cc, got %+v", i, bcc, email.Recipients[i])
+		}
+	}
+}
+
+func TestSessionCollectsAllRecipients(t *testing.T) {
+	s := &Session{}
+	for _, rcpt := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if err := s.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt failed: %v", err)
+		}
+	}
+	if len(s.to) != 3 {
+		t.Errorf("Expected 3 recipients, got %d", len(s.to))
+	}
+
+	s.Reset()
+	if len(s.to) != 0 {
+		t.Errorf("Expected recipients to be cleared on reset, got %d", len(s.to))
+	}
+}
+
+// failingStore rejects every message.
+type failingStore struct{}
+
+func (failingStore) Save(Email) error {
+	return errors.New("disk full")
+}
+
+// deliver sends body through server and returns the reply to the end of
+// DATA.
+func deliver(t *testing.T, server *Server, body string) error {
+	t.Helper()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(server.Stop)
+
+	client, err := smtp.Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(server.Port())))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	if err := client.Mail("sender@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := client.Rcpt("recipient@example.com"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	w.Write([]byte(body))
+	return w.Close()
+}
+
+func TestDataReportsSaveFailure(t *testing.T) {
+	err := deliver(t, NewServer(freePort(t), failingStore{}), "Subject: Test\r\n\r\nHello\r\n")
+	var reply *textproto.Error
+	if !errors.As(err, &reply) || reply.Code != 451 {
+		t.Errorf("Expected a 451 reply when the message cannot be stored, got %v", err)
+	}
+}
+
+func TestSetMaxMessageBytes(t *testing.T) {
+	server := NewServer(freePort(t), failingStore{})
+	server.SetMaxMessageBytes(100)
+	err := deliver(t, server, "Subject: Test\r\n\r\n"+strings.Repeat("x", 200)+"\r\n")
+	var reply *textproto.Error
+	if !errors.As(err, &reply) || reply.Code != 552 {
+		t.Errorf("Expected a 552 reply for a message over the limit, got %v", err)
+	}
+}
+
+func TestStartReportsBindError(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	server := NewServer(l.Addr().(*net.TCPAddr).Port, nil)
+	if err := server.Start(); err == nil {
+		server.Stop()
+		t.Fatal("Expected Start to fail on a port already in use")
+	}
+	if server.IsRunning() {
+		t.Error("Expected server not to be running after a failed start")
+	}
+	if server.Err() == nil {
+		t.Fatal("Expected the failure to be kept for display")
+	}
+	if reason := ListenErrorReason(server.Err()); reason != "address in use" {
+		t.Errorf("Expected reason %q, got %q", "address in use", reason)
+	}
+}
+
+func TestStartFallsBackToNextPort(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	busyPort := l.Addr().(*net.TCPAddr).Port
+
+	server := NewServer(busyPort, nil)
+	server.EnablePortFallback(true)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Expected Start to fall back to a free port, got %v", err)
+	}
+	defer server.Stop()
+
+	if server.Port() <= busyPort || server.Port() > busyPort+maxPortFallback {
+		t.Errorf("Expected a port after %d, got %d", busyPort, server.Port())
+	}
+	if server.Err() != nil {
+		t.Errorf("Expected no error after a successful start, got %v", server.Err())
+	}
+}
+
+func TestStartPicksFreePort(t *testing.T) {
+	server := NewServer(0, nil)
+	server.SetHost("127.0.0.1")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer server.Stop()
+
+	if server.Port() == 0 {
+		t.Fatal("Expected the bound port to be reported")
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(server.Port())))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestShutdownStopsServer(t *testing.T) {
+	server := NewServer(freePort(t), nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// Wait for the greeting, so the server is serving its listener
+	client, err := smtp.Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(server.Port())))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	client.Quit()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if server.IsRunning() {
+		t.Error("Expected server to be stopped")
+	}
+
+	if _, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(server.Port()))); err == nil {
+		t.Error("Expected listener to be closed after shutdown")
+	}
+}
@@ -0,0 +1,164 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoadTLSConfigGeneratesAndCachesCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := LoadTLSConfig("", "", dir)
+	if err != nil {
+		t.Fatalf("LoadTLSConfig failed: %v", err)
+	}
+	second, err := LoadTLSConfig("", "", dir)
+	if err != nil {
+		t.Fatalf("LoadTLSConfig failed on reload: %v", err)
+	}
+
+	a := first.Certificates[0].Certificate[0]
+	b := second.Certificates[0].Certificate[0]
+	if !bytes.Equal(a, b) {
+		t.Error("Expected the cached certificate to be reused")
+	}
+
+	leaf := second.Certificates[0].Leaf
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("Expected certificate to be valid for localhost: %v", err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("Expected certificate to be valid for 127.0.0.1: %v", err)
+	}
+}
+
+func TestLoadTLSConfigRequiresCertAndKey(t *testing.T) {
+	if _, err := LoadTLSConfig("cert.pem", "", t.TempDir()); err == nil {
+		t.Error("Expected an error when only a certificate is given")
+	}
+}
+
+// freePort returns a TCP port that was free at the time of the call.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// dialSMTP waits for a just-started server to accept connections.
+func dialSMTP(t *testing.T, addr string, dial func() (net.Conn, error)) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := dial()
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Failed to connect to %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSTARTTLSRecordsConnectionState(t *testing.T) {
+	store := NewCaptureStore()
+	tlsConfig, err := LoadTLSConfig("", "", t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadTLSConfig failed: %v", err)
+	}
+
+	server := NewServer(freePort(t), store)
+	server.EnableTLS(tlsConfig, true, 0)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer server.Stop()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(server.Port()))
+	conn := dialSMTP(t, addr, func() (net.Conn, error) { return net.Dial("tcp", addr) })
+	client, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		t.Fatal("Expected STARTTLS to be advertised")
+	}
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("StartTLS failed: %v", err)
+	}
+	sendTestMessage(t, client)
+
+	emails := store.Emails()
+	if len(emails) != 1 {
+		t.Fatalf("Expected 1 email, got %d", len(emails))
+	}
+	if emails[0].TLSVersion != "TLS 1.3" {
+		t.Errorf("Expected TLS 1.3 to be recorded, got %q", emails[0].TLSVersion)
+	}
+	if emails[0].TLSCipher == "" {
+		t.Error("Expected the cipher suite to be recorded")
+	}
+}
+
+func TestImplicitTLSListener(t *testing.T) {
+	store := NewCaptureStore()
+	tlsConfig, err := LoadTLSConfig("", "", t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadTLSConfig failed: %v", err)
+	}
+
+	server := NewServer(freePort(t), store)
+	server.EnableTLS(tlsConfig, false, freePort(t))
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer server.Stop()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(server.TLSPort()))
+	conn := dialSMTP(t, addr, func() (net.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	})
+	client, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	sendTestMessage(t, client)
+
+	emails := store.Emails()
+	if len(emails) != 1 || emails[0].TLSVersion == "" {
+		t.Fatalf("Expected one email received over TLS, got %+v", emails)
+	}
+}
+
+func sendTestMessage(t *testing.T, client *smtp.Client) {
+	t.Helper()
+	if err := client.Mail("sender@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := client.Rcpt("recipient@example.com"); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	if _, err := w.Write([]byte("Subject: Test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Closing DATA failed: %v", err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %v", err)
+	}
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// sseKeepAlive is how often an idle event stream sends a comment, so
+// proxies don't drop the connection.
+const sseKeepAlive = 30 * time.Second
+
+// APIServer exposes stored emails over HTTP using the MailHog v2 and Mailpit
+// v1 API shapes, so test suites written against those tools work unchanged.
+// It also serves the web UI.
+type APIServer struct {
+	host        string
+	port        int
+	store       Store
+	server      *http.Server
+	running     bool
+	blockRemote bool
+	// stopped is closed by Stop, ending WebSocket streams, which the HTTP
+	// server no longer tracks once hijacked.
+	stopped chan struct{}
+}
+
+func NewAPIServer(port int, store Store) *APIServer {
+	return &APIServer{
+		host:  "127.0.0.1",
+		port:  port,
+		store: store,
+	}
+}
+
+// SetHost sets the interface to listen on, "127.0.0.1" by default; an empty
+// host listens on every interface.
+func (a *APIServer) SetHost(host string) {
+	a.host = host
+}
+
+// BlockRemoteContent keeps remote images, styles and fonts out of HTML
+// shown in the web UI.
+func (a *APIServer) BlockRemoteContent(block bool) {
+	a.blockRemote = block
+}
+
+func (a *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Mailpit
+	mux.HandleFunc("GET /api/v1/messages", a.handleMailpitList)
+	mux.HandleFunc("DELETE /api/v1/messages", a.handleDeleteMessages)
+	mux.HandleFunc("GET /api/v1/search", a.handleMailpitList)
+	mux.HandleFunc("DELETE /api/v1/search", a.handleDeleteSearch)
+	mux.HandleFunc("GET /api/v1/message/{id}", a.handleMailpitMessage)
+	mux.HandleFunc("GET /api/v1/message/{id}/raw", a.handleRaw)
+	mux.HandleFunc("GET /api/v1/message/{id}/headers", a.handleHeaders)
+	mux.HandleFunc("GET /api/v1/message/{id}/part/{part}", a.handlePart)
+
+	// MailHog
+	mux.HandleFunc("GET /api/v2/messages", a.handleMailHogList)
+	mux.HandleFunc("GET /api/v2/search", a.handleMailHogSearch)
+	mux.HandleFunc("GET /api/v1/messages/{id}", a.handleMailHogMessage)
+	mux.HandleFunc("GET /api/v1/messages/{id}/download", a.handleRaw)
+	mux.HandleFunc("DELETE /api/v1/messages/{id}", a.handleDeleteMessage)
+
+	// Event stream, over WebSocket or Server-Sent Events
+	mux.HandleFunc("GET /api/events", a.handleEvents)
+
+	a.registerWebUI(mux)
+	return mux
+}
+
+// Start binds the listener and serves in the background.
+func (a *APIServer) Start() error {
+	if a.running {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(a.host, strconv.Itoa(a.port)))
+	if err != nil {
+		return err
+	}
+
+	a.server = &http.Server{
+		Handler:           a.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go a.server.Serve(listener)
+
+	a.stopped = make(chan struct{})
+	a.running = true
+	return nil
+}
+
+func (a *APIServer) Stop() {
+	if a.server != nil && a.running {
+		a.server.Close()
+		close(a.stopped)
+		a.running = false
+	}
+}
+
+func (a *APIServer) Port() int {
+	return a.port
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	http.Error(w, err.Error(), status)
+}
+
+// pagination reads the start and limit query parameters shared by MailHog
+// and Mailpit.
+func pagination(r *http.Request) (start, limit int) {
+	start, _ = strconv.Atoi(r.URL.Query().Get("start"))
+	if start < 0 {
+		start = 0
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageSize
+	}
+	return start, min(limit, maxPageSize)
+}
+
+// parseQueryFilter parses a filter query parameter, answering 400 when it
+// is invalid.
+func parseQueryFilter(w http.ResponseWriter, query string) (*Filter, bool) {
+	filter, err := ParseFilter(query, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return filter, true
+}
+
+// listPage loads the page of emails requested by r that match filter,
+// along with the total number of matches.
+func (a *APIServer) listPage(w http.ResponseWriter, r *http.Request, filter *Filter) (emails []Email, total, start int, ok bool) {
+	start, limit := pagination(r)
+
+	total, err := a.store.Count(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, 0, 0, false
+	}
+	emails, err = a.store.List(filter, start, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, 0, 0, false
+	}
+	return emails, total, start, true
+}
+
+// lookupEmail loads the email named by the {id} path value, accepting
+// Mailpit's "latest" alias.
+func (a *APIServer) lookupEmail(w http.ResponseWriter, r *http.Request) (*Email, bool) {
+	id := r.PathValue("id")
+
+	var email *Email
+	var err error
+	if id == "latest" {
+		var emails []Email
+		emails, err = a.store.List(nil, 0, 1)
+		if err == nil && len(emails) == 0 {
+			err = ErrNotFound
+		}
+		if err == nil {
+			email = &emails[0]
+		}
+	} else {
+		email, err = a.store.Get(id)
+	}
+
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("message %q not found", id))
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return email, true
+}
+
+func (a *APIServer) handleRaw(w http.ResponseWriter, r *http.Request) {
+	email, ok := a.lookupEmail(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	if strings.HasSuffix(r.URL.Path, "/download") {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", email.ID+".eml"))
+	}
+	w.Write(smtpd.RawSource(email.Email))
+}
+
+func (a *APIServer) handleHeaders(w http.ResponseWriter, r *http.Request) {
+	email, ok := a.lookupEmail(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, headersOrEmpty(email.Headers))
+}
+
+func (a *APIServer) handlePart(w http.ResponseWriter, r *http.Request) {
+	email, ok := a.lookupEmail(w, r)
+	if !ok {
+		return
+	}
+	index, err := strconv.Atoi(r.PathValue("part"))
+	if err != nil || index < 0 || index >= len(email.Parts) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("part %q not found", r.PathValue("part")))
+		return
+	}
+	part := email.Parts[index]
+	setPartHeaders(w.Header(), part.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachmentFilename(Attachment{PartIndex: index, Filename: part.Filename})))
+	w.Write(part.Content)
+}
+
+// setPartHeaders sets the headers for serving a part of a captured message.
+// The sender chose its content type, so browsers must not sniff it, and an
+// HTML or SVG part opened directly is sandboxed away from the API's origin.
+func setPartHeaders(h http.Header, contentType string) {
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "sandbox")
+}
+
+func (a *APIServer) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.lookupEmail(w, r); !ok {
+		return
+	}
+	if err := a.store.Delete(r.PathValue("id")); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDeleteMessages deletes the messages listed in a Mailpit-style
+// {"IDs": [...]} body, or every message when no IDs are given (MailHog).
+func (a *APIServer) handleDeleteMessages(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		IDs []string
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if len(request.IDs) == 0 {
+		if err := a.store.Clear(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	for _, id := range request.IDs {
+		if err := a.store.Delete(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func headersOrEmpty(header mail.Header) mail.Header {
+	if header == nil {
+		return mail.Header{}
+	}
+	return header
+}
+
+func snippet(email Email) string {
+	text := strings.Join(strings.Fields(email.TextBody()), " ")
+	if r := []rune(text); len(r) > 250 {
+		return string(r[:250]) + "..."
+	}
+	return text
+}
+
+// Mailpit API
+
+type mailpitAddress struct {
+	Name    string
+	Address string
+}
+
+type mailpitAttachment struct {
+	PartID      string
+	FileName    string
+	ContentType string
+	ContentID   string
+	Size        int
+}
+
+type mailpitSummary struct {
+	ID          string
+	MessageID   string
+	Read        bool
+	From        mailpitAddress
+	To          []mailpitAddress
+	Cc          []mailpitAddress
+	Bcc         []mailpitAddress
+	ReplyTo     []mailpitAddress
+	Subject     string
+	Created     time.Time
+	Tags        []string
+	Size        int
+	Attachments int
+	Snippet     string
+}
+
+type mailpitMessage struct {
+	ID          string
+	MessageID   string
+	From        mailpitAddress
+	To          []mailpitAddress
+	Cc          []mailpitAddress
+	Bcc         []mailpitAddress
+	ReplyTo     []mailpitAddress
+	ReturnPath  string
+	Subject     string
+	Date        time.Time
+	Tags        []string
+	Text        string
+	HTML        string
+	Size        int
+	Inline      []mailpitAttachment
+	Attachments []mailpitAttachment
+}
+
+func mailpitAddresses(header mail.Header, key string) []mailpitAddress {
+	addresses := []mailpitAddress{}
+	if header == nil || header.Get(key) == "" {
+		return addresses
+	}
+	list, err := header.AddressList(key)
+	if err != nil {
+		return addresses
+	}
+	for _, addr := range list {
+		addresses = append(addresses, mailpitAddress{Name: addr.Name, Address: addr.Address})
+	}
+	return addresses
+}
+
+func mailpitFrom(email Email) mailpitAddress {
+	if email.Headers != nil && email.Headers.Get("From") != "" {
+		if addr, err := mail.ParseAddress(email.Headers.Get("From")); err == nil {
+			return mailpitAddress{Name: addr.Name, Address: addr.Address}
+		}
+	}
+	return mailpitAddress{Address: email.From}
+}
+
+func mailpitTo(email Email) []mailpitAddress {
+	to := mailpitAddresses(email.Headers, "To")
+	if len(to) == 0 {
+		for _, rcpt := range email.Recipients {
+			if !rcpt.Bcc {
+				to = append(to, mailpitAddress{Address: rcpt.Address})
+			}
+		}
+	}
+	return to
+}
+
+func mailpitBcc(email Email) []mailpitAddress {
+	bcc := []mailpitAddress{}
+	for _, rcpt := range email.Recipients {
+		if rcpt.Bcc {
+			bcc = append(bcc, mailpitAddress{Address: rcpt.Address})
+		}
+	}
+	return bcc
+}
+
+func messageID(email Email) string {
+	if email.Headers == nil {
+		return ""
+	}
+	return strings.Trim(email.Headers.Get("Message-Id"), "<> ")
+}
+
+func newMailpitSummary(email Email) mailpitSummary {
+	return mailpitSummary{
+		ID:          email.ID,
+		MessageID:   messageID(email),
+		Read:        email.Read,
+		From:        mailpitFrom(email),
+		To:          mailpitTo(email),
+		Cc:          mailpitAddresses(email.Headers, "Cc"),
+		Bcc:         mailpitBcc(email),
+		ReplyTo:     mailpitAddresses(email.Headers, "Reply-To"),
+		Subject:     email.Subject,
+		Created:     email.CreatedAt,
+		Tags:        []string{},
+		Size:        len(smtpd.RawSource(email.Email)),
+		Attachments: len(email.Attachments),
+		Snippet:     snippet(email),
+	}
+}
+
+func newMailpitMessage(email Email) mailpitMessage {
+	message := mailpitMessage{
+		ID:          email.ID,
+		MessageID:   messageID(email),
+		From:        mailpitFrom(email),
+		To:          mailpitTo(email),
+		Cc:          mailpitAddresses(email.Headers, "Cc"),
+		Bcc:         mailpitBcc(email),
+		ReplyTo:     mailpitAddresses(email.Headers, "Reply-To"),
+		ReturnPath:  email.From,
+		Subject:     email.Subject,
+		Date:        email.CreatedAt,
+		Tags:        []string{},
+		Text:        email.TextBody(),
+		Size:        len(smtpd.RawSource(email.Email)),
+		Inline:      []mailpitAttachment{},
+		Attachments: []mailpitAttachment{},
+	}
+	if part, ok := email.BodyPart("text/html"); ok {
+		message.HTML = string(part.Content)
+	}
+	if date, err := mail.ParseDate(email.Date); err == nil {
+		message.Date = date
+	}
+
+	for _, attachment := range email.Attachments {
+		a := mailpitAttachment{
+			PartID:      strconv.Itoa(attachment.PartIndex),
+			FileName:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			ContentID:   attachment.ContentID,
+			Size:        attachment.Size,
+		}
+		if attachment.Disposition == "attachment" || attachment.ContentID == "" {
+			message.Attachments = append(message.Attachments, a)
+		} else {
+			message.Inline = append(message.Inline, a)
+		}
+	}
+	return message
+}
+
+func (a *APIServer) handleMailpitList(w http.ResponseWriter, r *http.Request) {
+	filter, ok := parseQueryFilter(w, r.URL.Query().Get("query"))
+	if !ok {
+		return
+	}
+	emails, total, start, ok := a.listPage(w, r, filter)
+	if !ok {
+		return
+	}
+
+	unreadFilter, _ := ParseFilter("is:unread", time.Now())
+	unread, err := a.store.Count(unreadFilter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	messages := make([]mailpitSummary, 0, len(emails))
+	for _, email := range emails {
+		messages = append(messages, newMailpitSummary(email))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"total":          total,
+		"unread":         unread,
+		"count":          len(messages),
+		"messages_count": total,
+		"start":          start,
+		"tags":           []string{},
+		"messages":       messages,
+	})
+}
+
+func (a *APIServer) handleDeleteSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("query")
+	if strings.TrimSpace(query) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("query is required"))
+		return
+	}
+	filter, ok := parseQueryFilter(w, query)
+	if !ok {
+		return
+	}
+	if _, err := a.store.DeleteMatching(filter); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *APIServer) handleMailpitMessage(w http.ResponseWriter, r *http.Request) {
+	email, ok := a.lookupEmail(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newMailpitMessage(*email))
+}
+
+// MailHog API
+
+type mailhogPath struct {
+	Relays  []string
+	Mailbox string
+	Domain  string
+	Params  string
+}
+
+type mailhogMessage struct {
+	ID      string
+	From    mailhogPath
+	To      []mailhogPath
+	Content struct {
+		Headers mail.Header
+		Body    string
+		Size    int
+		MIME    any
+	}
+	Created time.Time
+	MIME    any
+	Raw     struct {
+		From string
+		To   []string
+		Data string
+		Helo string
+	}
+}
+
+func newMailhogPath(address string) mailhogPath {
+	mailbox, domain, _ := strings.Cut(address, "@")
+	return mailhogPath{Mailbox: mailbox, Domain: domain}
+}
+
+func newMailhogMessage(email Email) mailhogMessage {
+	raw := smtpd.RawSource(email.Email)
+
+	message := mailhogMessage{
+		ID:      email.ID,
+		From:    newMailhogPath(email.From),
+		To:      []mailhogPath{},
+		Created: email.CreatedAt,
+	}
+	message.Content.Headers = headersOrEmpty(email.Headers)
+	message.Content.Body = email.Body
+	message.Content.Size = len(raw)
+	message.Raw.From = email.From
+	message.Raw.To = smtpd.RecipientAddresses(email.Recipients)
+	message.Raw.Data = string(raw)
+
+	for _, rcpt := range email.Recipients {
+		message.To = append(message.To, newMailhogPath(rcpt.Address))
+	}
+	return message
+}
+
+func (a *APIServer) handleMailHogList(w http.ResponseWriter, r *http.Request) {
+	a.writeMailHogList(w, r, nil)
+}
+
+// handleMailHogSearch maps MailHog's kind=from|to|containing search onto a
+// filter query.
+func (a *APIServer) handleMailHogSearch(w http.ResponseWriter, r *http.Request) {
+	value := `"` + strings.ReplaceAll(r.URL.Query().Get("query"), `"`, "") + `"`
+	var query string
+	switch kind := r.URL.Query().Get("kind"); kind {
+	case "from", "to":
+		query = kind + ":" + value
+	case "containing":
+		query = value
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown search kind %q", kind))
+		return
+	}
+
+	filter, ok := parseQueryFilter(w, query)
+	if !ok {
+		return
+	}
+	a.writeMailHogList(w, r, filter)
+}
+
+func (a *APIServer) writeMailHogList(w http.ResponseWriter, r *http.Request, filter *Filter) {
+	emails, total, start, ok := a.listPage(w, r, filter)
+	if !ok {
+		return
+	}
+
+	items := make([]mailhogMessage, 0, len(emails))
+	for _, email := range emails {
+		items = append(items, newMailhogMessage(email))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"total": total,
+		"count": len(items),
+		"start": start,
+		"items": items,
+	})
+}
+
+func (a *APIServer) handleMailHogMessage(w http.ResponseWriter, r *http.Request) {
+	email, ok := a.lookupEmail(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newMailhogMessage(*email))
+}
+
+// Event stream
+
+// handleEvents streams every Event as JSON: one WebSocket text message per
+// event when the client asks for an upgrade, and Server-Sent Events named
+// after the event type otherwise.
+func (a *APIServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handshake: checkWebSocketOrigin, Handler: a.streamWebSocket}.ServeHTTP(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+
+	sub := a.store.Subscribe()
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				// Dropped for falling behind; EventSource reconnects
+				return
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func (a *APIServer) streamWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	sub := a.store.Subscribe()
+	defer sub.Close()
+
+	// Clients only listen; reading detects when they go away
+	closed := make(chan struct{})
+	go func() {
+		var discard string
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-a.stopped:
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				// Dropped for falling behind
+				return
+			}
+			if err := websocket.JSON.Send(ws, event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkWebSocketOrigin accepts test harnesses, which send no Origin, and
+// pages served by lazySMTP itself, but not other websites.
+func checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("origin %q not allowed", origin)
+	}
+	config.Origin = u
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// multipartEmail has text and HTML alternatives and an attachment.
+const multipartEmail = "From: sender@example.com\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Subject: =?UTF-8?B?SW52b2ljZSDwn5OE?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Hello caf=C3=A9, your invoice is attached.=\r\n" +
+	" Thanks!\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+SGVsbG8gY2Fm6SwgeW91ciBpbnZvaWNlIGlzIGF0dGFj\r\n" +
+	"aGVkLjwvcD4=\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"invoice.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--outer--\r\n"
+
+func newTestAPI(t *testing.T, rawEmails ...string) *httptest.Server {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "api.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for i, raw := range rawEmails {
+		email := parseEmail(raw, "sender@example.com", []string{"recipient@example.com", "hidden@example.com"}, string(rune('a'+i)))
+		if err := SaveEmail(db, email); err != nil {
+			t.Fatalf("SaveEmail failed: %v", err)
+		}
+	}
+
+	server := httptest.NewServer(NewAPIServer(0, NewSQLiteStore(db)).Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func apiRequest(t *testing.T, method, url string, body io.Reader) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func decodeJSON(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+}
+
+func TestMailpitListPagination(t *testing.T) {
+	server := newTestAPI(t, multipartEmail, multipartEmail, multipartEmail)
+
+	var list struct {
+		Total    int
+		Unread   int
+		Count    int
+		Start    int
+		Messages []mailpitSummary
+	}
+	decodeJSON(t, apiRequest(t, "GET", server.URL+"/api/v1/messages?start=1&limit=1", nil), &list)
+
+	if list.Total != 3 || list.Unread != 3 || list.Count != 1 || list.Start != 1 {
+		t.Errorf("Expected total 3, unread 3, count 1, start 1, got %d, %d, %d, %d", list.Total, list.Unread, list.Count, list.Start)
+	}
+	if len(list.Messages) != 1 || list.Messages[0].ID != "b" {
+		t.Fatalf("Expected message b, got %+v", list.Messages)
+	}
+	if list.Messages[0].Attachments != 1 {
+		t.Errorf("Expected 1 attachment, got %d", list.Messages[0].Attachments)
+	}
+	if len(list.Messages[0].Bcc) != 1 || list.Messages[0].Bcc[0].Address != "hidden@example.com" {
+		t.Errorf("Expected hidden@example.com as Bcc, got %+v", list.Messages[0].Bcc)
+	}
+}
+
+func TestMailpitMessage(t *testing.T) {
+	server := newTestAPI(t, multipartEmail)
+
+	var message mailpitMessage
+	decodeJSON(t, apiRequest(t, "GET", server.URL+"/api/v1/message/latest", nil), &message)
+
+	if message.ID != "a" {
+		t.Errorf("Expected ID a, got %q", message.ID)
+	}
+	if message.Subject != "Invoice 📄" {
+		t.Errorf("Expected subject %q, got %q", "Invoice 📄", message.Subject)
+	}
+	if !strings.Contains(message.Text, "your invoice is attached") {
+		t.Errorf("Expected text body, got %q", message.Text)
+	}
+	if !strings.Contains(message.HTML, "<p>Hello café") {
+		t.Errorf("Expected HTML body, got %q", message.HTML)
+	}
+	if len(message.Attachments) != 1 || message.Attachments[0].FileName != "invoice.pdf" {
+		t.Fatalf("Expected invoice.pdf attachment, got %+v", message.Attachments)
+	}
+
+	resp := apiRequest(t, "GET", server.URL+"/api/v1/message/a/part/"+message.Attachments[0].PartID, nil)
+	content, _ := io.ReadAll(resp.Body)
+	if string(content) != "%PDF-1.4\n" {
+		t.Errorf("Expected attachment content, got %q", content)
+	}
+
+	// Parts chosen by the sender must not render in the API's origin
+	resp = apiRequest(t, "GET", server.URL+"/api/v1/message/a/part/1", nil)
+	for header, want := range map[string]string{
+		"Content-Type":            "text/html",
+		"Content-Disposition":     `attachment; filename="attachment-2"`,
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("Expected HTML part %s %q, got %q", header, want, got)
+		}
+	}
+}
+
+func TestRawAndDownload(t *testing.T) {
+	server := newTestAPI(t, multipartEmail)
+
+	for _, path := range []string{"/api/v1/message/a/raw", "/api/v1/messages/a/download"} {
+		resp := apiRequest(t, "GET", server.URL+path, nil)
+		raw, _ := io.ReadAll(resp.Body)
+		if string(raw) != multipartEmail {
+			t.Errorf("%s: raw source does not match the received message", path)
+		}
+	}
+}
+
+func TestMailHogList(t *testing.T) {
+	server := newTestAPI(t, multipartEmail)
+
+	var list struct {
+		Total int
+		Count int
+		Items []mailhogMessage
+	}
+	decodeJSON(t, apiRequest(t, "GET", server.URL+"/api/v2/messages", nil), &list)
+
+	if list.Total != 1 || len(list.Items) != 1 {
+		t.Fatalf("Expected 1 message, got total %d, items %d", list.Total, len(list.Items))
+	}
+	item := list.Items[0]
+	if item.From.Mailbox != "sender" || item.From.Domain != "example.com" {
+		t.Errorf("Expected sender@example.com, got %+v", item.From)
+	}
+	if len(item.To) != 2 {
+		t.Errorf("Expected 2 envelope recipients, got %d", len(item.To))
+	}
+	if got := item.Content.Headers.Get("Subject"); got != "=?UTF-8?B?SW52b2ljZSDwn5OE?=" {
+		t.Errorf("Expected Subject header, got %q", got)
+	}
+}
+
+func TestDeleteMessages(t *testing.T) {
+	server := newTestAPI(t, multipartEmail, multipartEmail, multipartEmail)
+
+	if resp := apiRequest(t, "DELETE", server.URL+"/api/v1/messages/a", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "GET", server.URL+"/api/v1/messages/a", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected deleted message to be gone, got status %d", resp.StatusCode)
+	}
+
+	apiRequest(t, "DELETE", server.URL+"/api/v1/messages", strings.NewReader(`{"IDs":["b"]}`))
+	var list struct{ Total int }
+	decodeJSON(t, apiRequest(t, "GET", server.URL+"/api/v1/messages", nil), &list)
+	if list.Total != 1 {
+		t.Errorf("Expected 1 message left, got %d", list.Total)
+	}
+
+	apiRequest(t, "DELETE", server.URL+"/api/v1/messages", nil)
+	decodeJSON(t, apiRequest(t, "GET", server.URL+"/api/v1/messages", nil), &list)
+	if list.Total != 0 {
+		t.Errorf("Expected no messages left, got %d", list.Total)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	server := newTestAPI(t, multipartEmail, "From: news@acme.test\r\nTo: list@acme.test\r\nSubject: Weekly news\r\n\r\nHello")
+
+	var list struct {
+		Total    int
+		Messages []mailpitSummary
+	}
+	decodeJSON(t, apiRequest(t, "GET", server.URL+"/api/v1/search?query="+url.QueryEscape("subject:weekly"), nil), &list)
+	if list.Total != 1 || len(list.Messages) != 1 || list.Messages[0].ID != "b" {
+		t.Errorf("Expected only message b, got %+v", list.Messages)
+	}
+
+	var mailhog struct{ Total int }
+	decodeJSON(t, apiRequest(t, "GET", server.URL+"/api/v2/search?kind=containing&query=invoice", nil), &mailhog)
+	if mailhog.Total != 1 {
+		t.Errorf("Expected 1 MailHog search result, got %d", mailhog.Total)
+	}
+
+	if resp := apiRequest(t, "GET", server.URL+"/api/v1/search?query=colour:red", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid query, got %d", resp.StatusCode)
+	}
+
+	apiRequest(t, "DELETE", server.URL+"/api/v1/search?query="+url.QueryEscape("has:attachment"), nil)
+	decodeJSON(t, apiRequest(t, "GET", server.URL+"/api/v1/messages", nil), &list)
+	if list.Total != 1 || list.Messages[0].ID != "b" {
+		t.Errorf("Expected only message b to be left, got %+v", list.Messages)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SaveAttachment writes an attachment of email into dir and returns the path
+// it was written to. Existing files are never overwritten; a numeric suffix
+// is added instead.
+func SaveAttachment(email Email, attachment Attachment, dir string) (string, error) {
+	content := email.AttachmentContent(attachment)
+	if content == nil {
+		return "", errors.New("attachment content not found")
+	}
+
+	dir = expandHome(dir)
+	if err := ensureDir(dir); err != nil {
+		return "", err
+	}
+
+	name := attachmentFilename(attachment)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	path := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(content); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
+
+// attachmentFilename returns a filename safe to create on disk, since the
+// name in the message is controlled by the sender.
+func attachmentFilename(attachment Attachment) string {
+	name := strings.ReplaceAll(attachment.Filename, "\\", "/")
+	name = filepath.Base(name)
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	if name == "" || name == "." || name == "/" || name == ".." {
+		name = fmt.Sprintf("attachment-%d", attachment.PartIndex+1)
+	}
+	return name
+}
+
+// GetDefaultSaveDir returns the directory offered when saving attachments.
+func GetDefaultSaveDir() string {
+	homeDir, err := os.UserHomeDir()
+	if err == nil {
+		downloads := filepath.Join(homeDir, "Downloads")
+		if info, err := os.Stat(downloads); err == nil && info.IsDir() {
+			return downloads
+		}
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		return cwd
+	}
+	return "."
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~"))
+}
+
+func formatSize(size int) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
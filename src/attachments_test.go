@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func TestAttachmentsFromParts(t *testing.T) {
+	email := parseEmail(multipartEmail, "sender@example.com", []string{"recipient@example.com"}, "att1")
+	if len(email.Attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got %d", len(email.Attachments))
+	}
+
+	attachment := email.Attachments[0]
+	if attachment.Filename != "invoice.pdf" {
+		t.Errorf("Expected filename invoice.pdf, got %q", attachment.Filename)
+	}
+	if attachment.ContentType != "application/pdf" {
+		t.Errorf("Expected application/pdf, got %q", attachment.ContentType)
+	}
+	if attachment.Disposition != "attachment" {
+		t.Errorf("Expected attachment disposition, got %q", attachment.Disposition)
+	}
+	if attachment.Size != len("%PDF-1.4\n") {
+		t.Errorf("Expected decoded size, got %d", attachment.Size)
+	}
+	if string(email.AttachmentContent(attachment)) != "%PDF-1.4\n" {
+		t.Errorf("Unexpected attachment content %q", email.AttachmentContent(attachment))
+	}
+}
+
+func TestSaveAttachment(t *testing.T) {
+	dir := t.TempDir()
+	email := Email{
+		Parts:       []Part{{Index: 0, ContentType: "text/csv", Filename: "report.csv", Content: []byte("a,b\n")}},
+		Attachments: []Attachment{{PartIndex: 0, Filename: "report.csv", ContentType: "text/csv", Size: 4}},
+	}
+
+	first, err := SaveAttachment(email, email.Attachments[0], dir)
+	if err != nil {
+		t.Fatalf("SaveAttachment failed: %v", err)
+	}
+	if first != filepath.Join(dir, "report.csv") {
+		t.Errorf("Unexpected path %q", first)
+	}
+
+	second, err := SaveAttachment(email, email.Attachments[0], dir)
+	if err != nil {
+		t.Fatalf("SaveAttachment failed: %v", err)
+	}
+	if second != filepath.Join(dir, "report (1).csv") {
+		t.Errorf("Expected existing file to be kept, got %q", second)
+	}
+
+	data, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatalf("Failed to read saved file: %v", err)
+	}
+	if string(data) != "a,b\n" {
+		t.Errorf("Unexpected saved content %q", data)
+	}
+}
+
+func TestAttachmentFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		expected string
+	}{
+		{"plain", "invoice.pdf", "invoice.pdf"},
+		{"path traversal", "../../etc/passwd", "passwd"},
+		{"windows path", `C:\Users\me\report.csv`, "report.csv"},
+		{"reserved characters", `a<b>:c?.txt`, "a_b__c_.txt"},
+		{"empty", "", "attachment-3"},
+		{"dot dot", "..", "attachment-3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := attachmentFilename(Attachment{PartIndex: 2, Filename: tt.filename})
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
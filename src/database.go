@@ -2,12 +2,20 @@ package main
 
 import (
 	"database/sql"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
+
+	"github.com/mouayed/lazysmtp/smtpd"
 )
 
 func InitDB(path string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)")
+	// Writers wait for each other instead of failing with SQLITE_BUSY, as
+	// the SMTP server, the TUI and the API share the database
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, err
 	}
@@ -16,19 +24,8 @@ func InitDB(path string) (*sql.DB, error) {
 		return nil, err
 	}
 
-	query := `
-	CREATE TABLE IF NOT EXISTS emails (
-		id TEXT PRIMARY KEY,
-		from_address TEXT NOT NULL,
-		to_address TEXT NOT NULL,
-		subject TEXT,
-		body TEXT,
-		date TEXT NOT NULL,
-		created_at INTEGER DEFAULT (strftime('%s', 'now'))
-	);
-	`
-	_, err = db.Exec(query)
-	if err != nil {
+	if err := migrate(db); err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -36,52 +33,479 @@ func InitDB(path string) (*sql.DB, error) {
 }
 
 func SaveEmail(db *sql.DB, email Email) error {
-	query := `
-	INSERT INTO emails (id, from_address, to_address, subject, body, date)
-	VALUES (?, ?, ?, ?, ?, ?)
-	`
-	_, err := db.Exec(query, email.ID, email.From, email.To, email.Subject, email.Body, email.Date)
-	return err
-}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-func GetAllEmails(db *sql.DB) ([]Email, error) {
 	query := `
-	SELECT id, from_address, to_address, subject, body, date
-	FROM emails
-	ORDER BY created_at DESC
+	INSERT INTO emails (id, from_address, to_address, subject, body, date, tls_version, tls_cipher, auth_user, size, source, read, starred, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(?, strftime('%s', 'now')))
 	`
-	rows, err := db.Query(query)
+	source := email.Source
+	if source == "" {
+		source = SourceSMTP
+	}
+	// A set CreatedAt is kept, so tests can backdate emails
+	var createdAt any
+	if !email.CreatedAt.IsZero() {
+		createdAt = email.CreatedAt.Unix()
+	}
+	result, err := tx.Exec(query, email.ID, email.From, email.To, email.Subject, email.Body, email.Date, email.TLSVersion, email.TLSCipher, email.AuthUser, emailSize(email), source, email.Read, email.Starred, createdAt)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	rowid, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for i, rcpt := range email.Recipients {
+		_, err = tx.Exec(`INSERT INTO recipients (email_id, position, address, bcc) VALUES (?, ?, ?, ?)`,
+			email.ID, i, rcpt.Address, rcpt.Bcc)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, part := range email.Parts {
+		_, err = tx.Exec(`
+		INSERT INTO parts (email_id, position, content_type, charset, disposition, filename, content_id, content)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, email.ID, part.Index, part.ContentType, part.Charset, part.Disposition, part.Filename, part.ContentID, part.Content)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, attachment := range email.Attachments {
+		_, err = tx.Exec(`
+		INSERT INTO attachments (email_id, position, part_position, filename, content_type, size, content_id, disposition)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, email.ID, i, attachment.PartIndex, attachment.Filename, attachment.ContentType, attachment.Size, attachment.ContentID, attachment.Disposition)
+		if err != nil {
+			return err
+		}
 	}
+
+	names := make([]string, 0, len(email.Headers))
+	for name := range email.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	position := 0
+	for _, name := range names {
+		for _, value := range email.Headers[name] {
+			_, err = tx.Exec(`INSERT INTO headers (email_id, position, name, value) VALUES (?, ?, ?, ?)`,
+				email.ID, position, name, value)
+			if err != nil {
+				return err
+			}
+			position++
+		}
+	}
+
+	if email.Raw != nil {
+		_, err = tx.Exec(`INSERT INTO raw_messages (email_id, data) VALUES (?, ?)`, email.ID, email.Raw)
+		if err != nil {
+			return err
+		}
+	}
+
+	addresses, headers := searchFields(email)
+	_, err = tx.Exec(`INSERT INTO emails_fts (rowid, subject, addresses, headers, body) VALUES (?, ?, ?, ?, ?)`,
+		rowid, email.Subject, addresses, headers, email.TextBody())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// emailSize is the size of the message as received, or of its body for
+// emails without a recorded source.
+func emailSize(email Email) int {
+	if email.Raw != nil {
+		return len(email.Raw)
+	}
+	return len(email.Body)
+}
+
+// searchFields flattens the addresses and headers of email into the text
+// indexed for full-text search.
+func searchFields(email Email) (addresses, headers string) {
+	fields := []string{email.From, email.To}
+	fields = append(fields, smtpd.RecipientAddresses(email.Recipients)...)
+
+	var lines []string
+	for name, values := range email.Headers {
+		for _, value := range values {
+			lines = append(lines, name+": "+value)
+		}
+	}
+	sort.Strings(lines)
+
+	return strings.Join(fields, " "), strings.Join(lines, "\n")
+}
+
+// emailColumns are the columns of the emails table read by scanEmails.
+const emailColumns = `id, from_address, to_address, subject, body, date, tls_version, tls_cipher, auth_user, created_at, source, read, starred`
+
+// summaryColumns are emailColumns with an empty body, for the email list.
+const summaryColumns = `id, from_address, to_address, subject, '', date, tls_version, tls_cipher, auth_user, created_at, source, read, starred`
+
+// scanEmails reads every row of an emails query and closes rows, so that
+// follow-up queries do not compete with it for a connection.
+func scanEmails(rows *sql.Rows) ([]Email, error) {
 	defer rows.Close()
 
 	var emails []Email
 	for rows.Next() {
 		var email Email
-		err := rows.Scan(&email.ID, &email.From, &email.To, &email.Subject, &email.Body, &email.Date)
+		var tlsVersion, tlsCipher, authUser sql.NullString
+		var createdAt sql.NullInt64
+		err := rows.Scan(&email.ID, &email.From, &email.To, &email.Subject, &email.Body, &email.Date, &tlsVersion, &tlsCipher, &authUser, &createdAt, &email.Source, &email.Read, &email.Starred)
 		if err != nil {
 			return nil, err
 		}
+		email.CreatedAt = time.Unix(createdAt.Int64, 0)
+		email.TLSVersion = tlsVersion.String
+		email.TLSCipher = tlsCipher.String
+		email.AuthUser = authUser.String
 		emails = append(emails, email)
 	}
+	return emails, rows.Err()
+}
+
+// loadRecipients fills in the envelope recipients of the given emails.
+func loadRecipients(db *sql.DB, emails []Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
 
+	index := make(map[string]int, len(emails))
+	for i := range emails {
+		index[emails[i].ID] = i
+	}
+
+	query := `SELECT email_id, address, bcc FROM recipients ORDER BY email_id, position`
+	args := []any{}
+	if len(emails) == 1 {
+		query = `SELECT email_id, address, bcc FROM recipients WHERE email_id = ? ORDER BY position`
+		args = append(args, emails[0].ID)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var rcpt Recipient
+		if err := rows.Scan(&id, &rcpt.Address, &rcpt.Bcc); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			emails[i].Recipients = append(emails[i].Recipients, rcpt)
+		}
+	}
+
+	return rows.Err()
+}
+
+// loadParts fills in the MIME parts of the given emails.
+func loadParts(db *sql.DB, emails []Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(emails))
+	for i := range emails {
+		index[emails[i].ID] = i
+	}
+
+	query := `
+	SELECT email_id, position, content_type, charset, disposition, filename, content_id, content
+	FROM parts
+	ORDER BY email_id, position
+	`
+	args := []any{}
+	if len(emails) == 1 {
+		query = `
+		SELECT email_id, position, content_type, charset, disposition, filename, content_id, content
+		FROM parts
+		WHERE email_id = ?
+		ORDER BY position
+		`
+		args = append(args, emails[0].ID)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var part Part
+		var charset, disposition, filename, contentID sql.NullString
+		err := rows.Scan(&id, &part.Index, &part.ContentType, &charset, &disposition, &filename, &contentID, &part.Content)
+		if err != nil {
+			return err
+		}
+		part.Charset = charset.String
+		part.Disposition = disposition.String
+		part.Filename = filename.String
+		part.ContentID = contentID.String
+		if i, ok := index[id]; ok {
+			emails[i].Parts = append(emails[i].Parts, part)
+		}
+	}
+
+	return rows.Err()
+}
+
+// loadAttachments fills in the attachment metadata of the given emails.
+func loadAttachments(db *sql.DB, emails []Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(emails))
+	for i := range emails {
+		index[emails[i].ID] = i
+	}
+
+	query := `
+	SELECT email_id, part_position, filename, content_type, size, content_id, disposition
+	FROM attachments
+	ORDER BY email_id, position
+	`
+	args := []any{}
+	if len(emails) == 1 {
+		query = `
+		SELECT email_id, part_position, filename, content_type, size, content_id, disposition
+		FROM attachments
+		WHERE email_id = ?
+		ORDER BY position
+		`
+		args = append(args, emails[0].ID)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var attachment Attachment
+		var filename, contentID, disposition sql.NullString
+		err := rows.Scan(&id, &attachment.PartIndex, &filename, &attachment.ContentType, &attachment.Size, &contentID, &disposition)
+		if err != nil {
+			return err
+		}
+		attachment.Filename = filename.String
+		attachment.ContentID = contentID.String
+		attachment.Disposition = disposition.String
+		if i, ok := index[id]; ok {
+			emails[i].Attachments = append(emails[i].Attachments, attachment)
+		}
+	}
+
+	return rows.Err()
+}
+
+// loadHeaders fills in the header fields of the given emails.
+func loadHeaders(db *sql.DB, emails []Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(emails))
+	for i := range emails {
+		index[emails[i].ID] = i
+		emails[i].Headers = make(mail.Header)
+	}
+
+	query := `SELECT email_id, name, value FROM headers ORDER BY email_id, position`
+	args := []any{}
+	if len(emails) == 1 {
+		query = `SELECT email_id, name, value FROM headers WHERE email_id = ? ORDER BY position`
+		args = append(args, emails[0].ID)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, name, value string
+		if err := rows.Scan(&id, &name, &value); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			emails[i].Headers[name] = append(emails[i].Headers[name], value)
+		}
+	}
+
+	return rows.Err()
+}
+
+// loadRaw fills in the raw message source of the given emails.
+func loadRaw(db *sql.DB, emails []Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(emails))
+	for i := range emails {
+		index[emails[i].ID] = i
+	}
+
+	query := `SELECT email_id, data FROM raw_messages`
+	args := []any{}
+	if len(emails) == 1 {
+		query = `SELECT email_id, data FROM raw_messages WHERE email_id = ?`
+		args = append(args, emails[0].ID)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			emails[i].Raw = data
+		}
+	}
+
+	return rows.Err()
+}
+
+func GetAllEmails(db *sql.DB) ([]Email, error) {
+	query := `
+	SELECT ` + emailColumns + `
+	FROM emails
+	ORDER BY created_at DESC, rowid DESC
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	emails, err := scanEmails(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadDetails(db, emails); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// FilterEmails returns the emails matching filter, newest first, skipping
+// the first offset. A limit of 0 returns all of them.
+func FilterEmails(db *sql.DB, filter *Filter, offset, limit int) ([]Email, error) {
+	emails, err := queryFilteredEmails(db, emailColumns, filter, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadDetails(db, emails); err != nil {
+		return nil, err
+	}
 	return emails, nil
 }
 
+// FilterEmailSummaries is FilterEmails reading only the emails table, so
+// it leaves out the body, recipients, parts, headers and raw source.
+func FilterEmailSummaries(db *sql.DB, filter *Filter, offset, limit int) ([]Email, error) {
+	return queryFilteredEmails(db, summaryColumns, filter, offset, limit)
+}
+
+func queryFilteredEmails(db *sql.DB, columns string, filter *Filter, offset, limit int) ([]Email, error) {
+	where, args := filter.SQL()
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.Query(`
+	SELECT `+columns+`
+	FROM emails
+	WHERE `+where+`
+	ORDER BY created_at DESC, rowid DESC
+	LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanEmails(rows)
+}
+
+// CountFilteredEmails returns how many emails match filter.
+func CountFilteredEmails(db *sql.DB, filter *Filter) (int, error) {
+	where, args := filter.SQL()
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM emails WHERE `+where, args...).Scan(&count)
+	return count, err
+}
+
 func GetEmailByID(db *sql.DB, id string) (*Email, error) {
 	query := `
-	SELECT id, from_address, to_address, subject, body, date
+	SELECT ` + emailColumns + `
 	FROM emails
 	WHERE id = ?
 	`
-	row := db.QueryRow(query, id)
-	var email Email
-	err := row.Scan(&email.ID, &email.From, &email.To, &email.Subject, &email.Body, &email.Date)
+	rows, err := db.Query(query, id)
 	if err != nil {
 		return nil, err
 	}
-	return &email, nil
+
+	emails, err := scanEmails(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(emails) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	if err := loadDetails(db, emails); err != nil {
+		return nil, err
+	}
+	return &emails[0], nil
+}
+
+// loadDetails fills in everything stored outside the emails table.
+func loadDetails(db *sql.DB, emails []Email) error {
+	loaders := []func(*sql.DB, []Email) error{
+		loadRecipients,
+		loadParts,
+		loadAttachments,
+		loadHeaders,
+		loadRaw,
+	}
+	for _, load := range loaders {
+		if err := load(db, emails); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func DeleteEmail(db *sql.DB, id string) error {
@@ -90,12 +514,106 @@ func DeleteEmail(db *sql.DB, id string) error {
 	return err
 }
 
+// SetEmailRead marks the email with id read or unread.
+func SetEmailRead(db *sql.DB, id string, read bool) error {
+	_, err := db.Exec(`UPDATE emails SET read = ? WHERE id = ?`, read, id)
+	return err
+}
+
+// SetEmailStarred stars or unstars the email with id.
+func SetEmailStarred(db *sql.DB, id string, starred bool) error {
+	_, err := db.Exec(`UPDATE emails SET starred = ? WHERE id = ?`, starred, id)
+	return err
+}
+
 func DeleteAllEmails(db *sql.DB) error {
 	query := `DELETE FROM emails`
 	_, err := db.Exec(query)
 	return err
 }
 
+// DeleteFilteredEmails deletes every email matching filter and returns
+// their IDs.
+func DeleteFilteredEmails(db *sql.DB, filter *Filter) ([]string, error) {
+	where, args := filter.SQL()
+	rows, err := db.Query(`DELETE FROM emails WHERE `+where+` RETURNING id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// PruneEmails deletes the emails outside retention, oldest first, and
+// returns their IDs.
+func PruneEmails(db *sql.DB, retention Retention, now time.Time) ([]string, error) {
+	var conditions []string
+	var args []any
+	if retention.MaxCount > 0 {
+		conditions = append(conditions, `position > ?`)
+		args = append(args, retention.MaxCount)
+	}
+	if retention.MaxSize > 0 {
+		conditions = append(conditions, `running > ?`)
+		args = append(args, retention.MaxSize)
+	}
+	if retention.MaxAge > 0 {
+		conditions = append(conditions, `created_at < ?`)
+		args = append(args, now.Add(-retention.MaxAge).Unix())
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`
+	DELETE FROM emails WHERE rowid IN (
+		SELECT rowid FROM (
+			SELECT rowid, created_at,
+				ROW_NUMBER() OVER newest AS position,
+				SUM(size) OVER newest AS running
+			FROM emails
+			WINDOW newest AS (ORDER BY created_at DESC, rowid DESC)
+		)
+		WHERE `+strings.Join(conditions, " OR ")+`
+	) RETURNING id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetStoreStats returns the number and total size of the stored emails and
+// the size of the database file.
+func GetStoreStats(db *sql.DB) (StoreStats, error) {
+	var stats StoreStats
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM emails`).Scan(&stats.Count, &stats.Size)
+	if err != nil {
+		return stats, err
+	}
+	err = db.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&stats.Disk)
+	return stats, err
+}
+
 func CountEmails(db *sql.DB) (int, error) {
 	query := `SELECT COUNT(*) FROM emails`
 	row := db.QueryRow(query)
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
 )
 
 func TestInitDB(t *testing.T) {
@@ -266,3 +272,374 @@ func TestDatabasePersistence(t *testing.T) {
 		t.Errorf("Persistence failed: expected %s, got %s", "Persistence Test", retrieved.Subject)
 	}
 }
+
+func TestSaveEmailRecipients(t *testing.T) {
+	db, err := InitDB(":memory:")
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	email := Email{
+		ID:      "rcpts",
+		From:    "from@example.com",
+		To:      "to@example.com",
+		Subject: "Recipients",
+		Body:    "Body",
+		Date:    "Mon, 01 Jan 2026 00:00:00 UTC",
+		Recipients: []Recipient{
+			{Address: "to@example.com"},
+			{Address: "hidden@example.com", Bcc: true},
+		},
+	}
+
+	if err := SaveEmail(db, email); err != nil {
+		t.Fatalf("SaveEmail failed: %v", err)
+	}
+
+	retrieved, err := GetEmailByID(db, "rcpts")
+	if err != nil {
+		t.Fatalf("GetEmailByID failed: %v", err)
+	}
+	if len(retrieved.Recipients) != 2 {
+		t.Fatalf("Expected 2 recipients, got %d", len(retrieved.Recipients))
+	}
+	if retrieved.Recipients[1].Address != "hidden@example.com" || !retrieved.Recipients[1].Bcc {
+		t.Errorf("Expected hidden bcc recipient, got %+v", retrieved.Recipients[1])
+	}
+
+	all, err := GetAllEmails(db)
+	if err != nil {
+		t.Fatalf("GetAllEmails failed: %v", err)
+	}
+	if len(all) != 1 || len(all[0].Recipients) != 2 {
+		t.Errorf("Expected recipients to be loaded by GetAllEmails")
+	}
+
+	if err := DeleteEmail(db, "rcpts"); err != nil {
+		t.Fatalf("DeleteEmail failed: %v", err)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM recipients`).Scan(&count); err != nil {
+		t.Fatalf("Count recipients failed: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected recipients to be deleted with email, got %d", count)
+	}
+}
+
+func TestSaveEmailParts(t *testing.T) {
+	db, err := InitDB(":memory:")
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	email := parseEmail(multipartEmail, "sender@example.com", []string{"recipient@example.com"}, "parts")
+	if err := SaveEmail(db, email); err != nil {
+		t.Fatalf("SaveEmail failed: %v", err)
+	}
+
+	retrieved, err := GetEmailByID(db, "parts")
+	if err != nil {
+		t.Fatalf("GetEmailByID failed: %v", err)
+	}
+	if len(retrieved.Parts) != len(email.Parts) {
+		t.Fatalf("Expected %d parts, got %d", len(email.Parts), len(retrieved.Parts))
+	}
+	for i, part := range email.Parts {
+		got := retrieved.Parts[i]
+		if got.ContentType != part.ContentType || string(got.Content) != string(part.Content) || got.Filename != part.Filename {
+			t.Errorf("Part %d mismatch: expected %+v, got %+v", i, part, got)
+		}
+	}
+	if retrieved.HTMLBody() != email.HTMLBody() {
+		t.Errorf("Expected HTML body to round-trip")
+	}
+}
+
+func TestSaveEmailAttachments(t *testing.T) {
+	db, err := InitDB(":memory:")
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	email := parseEmail(multipartEmail, "sender@example.com", []string{"recipient@example.com"}, "attachments")
+	if err := SaveEmail(db, email); err != nil {
+		t.Fatalf("SaveEmail failed: %v", err)
+	}
+
+	retrieved, err := GetEmailByID(db, "attachments")
+	if err != nil {
+		t.Fatalf("GetEmailByID failed: %v", err)
+	}
+	if len(retrieved.Attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got %d", len(retrieved.Attachments))
+	}
+	if retrieved.Attachments[0] != email.Attachments[0] {
+		t.Errorf("Expected %+v, got %+v", email.Attachments[0], retrieved.Attachments[0])
+	}
+	if string(retrieved.AttachmentContent(retrieved.Attachments[0])) != "%PDF-1.4\n" {
+		t.Errorf("Expected attachment content to be loaded from its part")
+	}
+}
+
+func TestSaveEmailHeadersAndRaw(t *testing.T) {
+	db, err := InitDB(":memory:")
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	raw := "Received: from a.example.com\r\n" +
+		"Received: from b.example.com\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Subject: Headers\r\n" +
+		"\r\n" +
+		"Body\r\n"
+	email := parseEmail(raw, "from@example.com", []string{"to@example.com"}, "headers")
+	if err := SaveEmail(db, email); err != nil {
+		t.Fatalf("SaveEmail failed: %v", err)
+	}
+
+	all, err := GetAllEmails(db)
+	if err != nil {
+		t.Fatalf("GetAllEmails failed: %v", err)
+	}
+	if len(all) != 1 {
+		t.Fatalf("Expected 1 email, got %d", len(all))
+	}
+	retrieved := all[0]
+
+	if got := retrieved.Headers.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Expected Content-Type to persist, got %q", got)
+	}
+	received := retrieved.Headers["Received"]
+	if len(received) != 2 || received[0] != "from a.example.com" || received[1] != "from b.example.com" {
+		t.Errorf("Expected both Received headers in order, got %v", received)
+	}
+	if string(retrieved.Raw) != raw {
+		t.Errorf("Expected raw source to round-trip exactly, got %q", retrieved.Raw)
+	}
+}
+
+// baselineSchema is the schema created by lazysmtp before migrations existed.
+const baselineSchema = `
+CREATE TABLE IF NOT EXISTS emails (
+	id TEXT PRIMARY KEY,
+	from_address TEXT NOT NULL,
+	to_address TEXT NOT NULL,
+	subject TEXT,
+	body TEXT,
+	date TEXT NOT NULL,
+	created_at INTEGER DEFAULT (strftime('%s', 'now'))
+);
+`
+
+func TestMigrateFromBaselineSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.db")
+
+	old, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("Failed to open baseline database: %v", err)
+	}
+	if _, err := old.Exec(baselineSchema); err != nil {
+		t.Fatalf("Failed to create baseline schema: %v", err)
+	}
+	_, err = old.Exec(`INSERT INTO emails (id, from_address, to_address, subject, body, date) VALUES (?, ?, ?, ?, ?, ?)`,
+		"legacy", "from@example.com", "to@example.com", "Legacy", "Old body", "Mon, 01 Jan 2026 00:00:00 UTC")
+	if err != nil {
+		t.Fatalf("Failed to insert baseline email: %v", err)
+	}
+	old.Close()
+
+	db, err := InitDB(path)
+	if err != nil {
+		t.Fatalf("InitDB failed to upgrade baseline database: %v", err)
+	}
+	defer db.Close()
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatalf("SchemaVersion failed: %v", err)
+	}
+	if latest := migrations[len(migrations)-1].version; version != latest {
+		t.Errorf("Expected schema version %d, got %d", latest, version)
+	}
+
+	legacy, err := GetEmailByID(db, "legacy")
+	if err != nil {
+		t.Fatalf("GetEmailByID failed for pre-migration email: %v", err)
+	}
+	if legacy.Subject != "Legacy" || legacy.TextBody() != "Old body" {
+		t.Errorf("Pre-migration email not preserved: %+v", legacy)
+	}
+	if len(legacy.Recipients) != 0 || len(legacy.Parts) != 0 || len(legacy.Raw) != 0 {
+		t.Errorf("Expected pre-migration email to have no recorded extras")
+	}
+	if found, err := NewSQLiteStore(db).List(mustParseFilter(t, "old body"), 0, 0); err != nil || len(found) != 1 {
+		t.Errorf("Expected pre-migration email to be indexed for search, got %d results (%v)", len(found), err)
+	}
+
+	email := parseEmail(multipartEmail, "sender@example.com", []string{"recipient@example.com"}, "upgraded")
+	if err := SaveEmail(db, email); err != nil {
+		t.Fatalf("SaveEmail failed after upgrade: %v", err)
+	}
+	count, err := CountEmails(db)
+	if err != nil {
+		t.Fatalf("CountEmails failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 emails after upgrade, got %d", count)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "twice.db")
+
+	for i := 0; i < 2; i++ {
+		db, err := InitDB(path)
+		if err != nil {
+			t.Fatalf("InitDB run %d failed: %v", i+1, err)
+		}
+		var applied int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&applied); err != nil {
+			t.Fatalf("Failed to count applied migrations: %v", err)
+		}
+		if applied != len(migrations) {
+			t.Errorf("Run %d: expected %d applied migrations, got %d", i+1, len(migrations), applied)
+		}
+		db.Close()
+	}
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Migration %q has version %d, expected %d", m.description, m.version, i+1)
+		}
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "newer.db")
+
+	db, err := InitDB(path)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO schema_version (version, description) VALUES (?, ?)`, len(migrations)+1, "from the future")
+	if err != nil {
+		t.Fatalf("Failed to record future migration: %v", err)
+	}
+	db.Close()
+
+	if db, err := InitDB(path); err == nil {
+		db.Close()
+		t.Error("Expected InitDB to refuse a schema newer than it supports")
+	}
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "rollback.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	broken := migration{len(migrations) + 1, "broken", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`CREATE TABLE half_done (id INTEGER)`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`THIS IS NOT SQL`)
+		return err
+	}}
+	if err := applyMigration(db, broken); err == nil {
+		t.Fatal("Expected broken migration to fail")
+	}
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatalf("SchemaVersion failed: %v", err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Expected version to stay at %d, got %d", len(migrations), version)
+	}
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'`).Scan(&tables); err != nil {
+		t.Fatalf("Failed to inspect schema: %v", err)
+	}
+	if tables != 0 {
+		t.Error("Expected partial migration to be rolled back")
+	}
+}
+
+func mustParseFilter(t *testing.T, query string) *Filter {
+	t.Helper()
+	filter, err := ParseFilter(query, time.Now())
+	if err != nil {
+		t.Fatalf("ParseFilter(%q) failed: %v", query, err)
+	}
+	return filter
+}
+
+func TestFullTextSearch(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "search.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	reset := parseEmail("From: accounts@shop.test\r\nTo: alice@acme.test\r\nSubject: Reset your password\r\n\r\nUse this link to choose a new password.",
+		"accounts@shop.test", []string{"alice@acme.test"}, "reset")
+	invoice := parseEmail(multipartEmail, "billing@shop.test", []string{"bob@example.com"}, "invoice")
+	for _, email := range []Email{reset, invoice} {
+		if err := SaveEmail(db, email); err != nil {
+			t.Fatalf("SaveEmail failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"invoice", "reset"}},
+		{"password", []string{"reset"}},
+		{"pass", []string{"reset"}},
+		{"PASSWORD link", []string{"reset"}},
+		{"password invoice", nil},
+		{"alice@acme.test", []string{"reset"}},
+		{"bob", []string{"invoice"}},
+		{"cafe", []string{"invoice"}},
+		{"MIME-Version", []string{"invoice"}},
+	}
+
+	store := NewSQLiteStore(db)
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			found, err := store.List(mustParseFilter(t, tt.query), 0, 0)
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			var ids []string
+			for _, email := range found {
+				ids = append(ids, email.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Expected %v, got %v", tt.want, ids)
+			}
+		})
+	}
+
+	if err := DeleteEmail(db, "reset"); err != nil {
+		t.Fatalf("DeleteEmail failed: %v", err)
+	}
+	if found, _ := store.List(mustParseFilter(t, "password"), 0, 0); len(found) != 0 {
+		t.Errorf("Expected deleted email to be removed from the index")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+)
+
+// emailListWindow is how many summaries EmailList keeps loaded around the
+// cursor.
+const emailListWindow = 200
+
+// emailListBodies caps how many full emails EmailList keeps cached.
+const emailListBodies = 64
+
+// EmailList backs the TUI email list. It loads only the summaries in a
+// window around the cursor and fetches the full email once it is selected,
+// so moving the cursor costs the same however many emails are stored.
+type EmailList struct {
+	store    Store
+	filter   *Filter
+	total    int
+	selected int     // -1 when nothing is selected
+	top      int     // first row shown in the view
+	offset   int     // position of window[0] in the list
+	window   []Email // summaries
+	bodies   map[string]*Email
+	rendered map[string]string // by email ID and render key
+}
+
+func NewEmailList(store Store) *EmailList {
+	return &EmailList{store: store, selected: -1, bodies: map[string]*Email{}, rendered: map[string]string{}}
+}
+
+// SetFilter narrows the list down to the emails matching filter and clears
+// the selection.
+func (l *EmailList) SetFilter(filter *Filter) error {
+	l.filter = filter
+	l.selected = -1
+	l.top = 0
+	return l.Reload()
+}
+
+// Reload picks up changes to the store, keeping the cursor on the same row.
+func (l *EmailList) Reload() error {
+	total, err := l.store.Count(l.filter)
+	if err != nil {
+		return err
+	}
+	l.total = total
+	l.selected = min(l.selected, total-1)
+	l.window = nil
+	clear(l.bodies)
+	clear(l.rendered)
+	return nil
+}
+
+// Len returns how many emails match the filter.
+func (l *EmailList) Len() int {
+	return l.total
+}
+
+// Selected returns the row of the cursor, or -1.
+func (l *EmailList) Selected() int {
+	return l.selected
+}
+
+// Select moves the cursor to row i, clamped to the list.
+func (l *EmailList) Select(i int) {
+	l.selected = max(min(i, l.total-1), -1)
+}
+
+// Visible returns the first row and the summaries of a view height rows
+// tall, scrolled just enough to keep the cursor in sight.
+func (l *EmailList) Visible(height int) (int, []Email, error) {
+	height = max(height, 1)
+	if l.selected >= 0 {
+		if l.selected < l.top {
+			l.top = l.selected
+		}
+		if l.selected >= l.top+height {
+			l.top = l.selected - height + 1
+		}
+	}
+	l.top = max(min(l.top, l.total-height), 0)
+
+	if err := l.ensure(l.top, l.top+height); err != nil {
+		return l.top, nil, err
+	}
+	from := l.top - l.offset
+	to := min(l.top+height, l.total, l.offset+len(l.window)) - l.offset
+	if from < 0 || from >= to {
+		return l.top, nil, nil
+	}
+	return l.top, l.window[from:to], nil
+}
+
+// Summary returns the summary of row i, or nil if there is none.
+func (l *EmailList) Summary(i int) (*Email, error) {
+	if i < 0 || i >= l.total {
+		return nil, nil
+	}
+	if err := l.ensure(i, i+1); err != nil {
+		return nil, err
+	}
+	if i < l.offset || i >= l.offset+len(l.window) {
+		return nil, nil
+	}
+	return &l.window[i-l.offset], nil
+}
+
+// Current returns the selected email in full, or nil if nothing is
+// selected. Each email is fetched from the store once and then cached.
+func (l *EmailList) Current() (*Email, error) {
+	summary, err := l.Summary(l.selected)
+	if summary == nil || err != nil {
+		return nil, err
+	}
+	if email, ok := l.bodies[summary.ID]; ok {
+		return email, nil
+	}
+
+	email, err := l.store.Get(summary.ID)
+	if errors.Is(err, ErrNotFound) {
+		// Deleted since the window was loaded
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(l.bodies) >= emailListBodies {
+		clear(l.bodies)
+	}
+	l.bodies[summary.ID] = email
+	return email, nil
+}
+
+// Rendered returns render(), cached per email id and key until the next
+// Reload, so scrolling does not render the body again.
+func (l *EmailList) Rendered(id, key string, render func() string) string {
+	key = id + "\x00" + key
+	if text, ok := l.rendered[key]; ok {
+		return text
+	}
+	if len(l.rendered) >= emailListBodies {
+		clear(l.rendered)
+	}
+	text := render()
+	l.rendered[key] = text
+	return text
+}
+
+// MarkRead marks the selected email read.
+func (l *EmailList) MarkRead() error {
+	summary, err := l.Summary(l.selected)
+	if summary == nil || err != nil || summary.Read {
+		return err
+	}
+	if err := l.store.SetRead(summary.ID, true); err != nil {
+		return err
+	}
+	summary.Read = true
+	if email, ok := l.bodies[summary.ID]; ok {
+		email.Read = true
+	}
+	return nil
+}
+
+// ToggleStarred stars or unstars the selected email.
+func (l *EmailList) ToggleStarred() error {
+	summary, err := l.Summary(l.selected)
+	if summary == nil || err != nil {
+		return err
+	}
+	starred := !summary.Starred
+	if err := l.store.SetStarred(summary.ID, starred); err != nil {
+		return err
+	}
+	summary.Starred = starred
+	if email, ok := l.bodies[summary.ID]; ok {
+		email.Starred = starred
+	}
+	return nil
+}
+
+// ensure loads a new window unless rows from to to-1 are all in the
+// current one.
+func (l *EmailList) ensure(from, to int) error {
+	to = min(to, l.total)
+	if from >= to || (l.window != nil && from >= l.offset && to <= l.offset+len(l.window)) {
+		return nil
+	}
+	size := max(emailListWindow, to-from)
+	offset := max(from-(size-(to-from))/2, 0)
+	window, err := l.store.Summaries(l.filter, offset, size)
+	if err != nil {
+		return err
+	}
+	l.offset, l.window = offset, window
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// countingStore records the calls EmailList makes.
+type countingStore struct {
+	Store
+	summaries, gets int
+}
+
+func (s *countingStore) Summaries(filter *Filter, offset, limit int) ([]Email, error) {
+	s.summaries++
+	return s.Store.Summaries(filter, offset, limit)
+}
+
+func (s *countingStore) Get(id string) (*Email, error) {
+	s.gets++
+	return s.Store.Get(id)
+}
+
+// seedEmails saves n emails to a new SQLite store, email-0 being the newest.
+func seedEmails(tb testing.TB, n int) Store {
+	tb.Helper()
+	db, err := InitDB(filepath.Join(tb.TempDir(), "list.db"))
+	if err != nil {
+		tb.Fatalf("InitDB failed: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	// Saved oldest first, as they would arrive
+	for i := n - 1; i >= 0; i-- {
+		raw := fmt.Sprintf("Subject: Message %d\r\n\r\nBody of message %d", i, i)
+		email := parseEmail(raw, "app@example.com", []string{"user@example.com"}, fmt.Sprintf("email-%d", i))
+		if err := SaveEmail(db, email); err != nil {
+			tb.Fatalf("SaveEmail failed: %v", err)
+		}
+	}
+	return NewSQLiteStore(db)
+}
+
+func TestEmailList(t *testing.T) {
+	store := &countingStore{Store: seedEmails(t, 500)}
+	list := NewEmailList(store)
+	if err := list.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if list.Len() != 500 || list.Selected() != -1 {
+		t.Fatalf("Expected 500 emails and no selection, got %d and %d", list.Len(), list.Selected())
+	}
+
+	top, rows, err := list.Visible(10)
+	if err != nil || top != 0 || len(rows) != 10 || rows[0].ID != "email-0" {
+		t.Fatalf("Expected the first 10 rows, got top %d, %d rows, %v", top, len(rows), err)
+	}
+	if rows[0].Body != "" || rows[0].Raw != nil || rows[0].Recipients != nil {
+		t.Errorf("Expected summaries only, got %+v", rows[0])
+	}
+
+	// Moving within the window runs no queries
+	for i := range 50 {
+		list.Select(i)
+		list.Visible(10)
+	}
+	if store.summaries != 1 {
+		t.Errorf("Expected 1 window load, got %d", store.summaries)
+	}
+	top, rows, _ = list.Visible(10)
+	if top != 40 || rows[len(rows)-1].ID != "email-49" {
+		t.Errorf("Expected the view scrolled to keep email-49 last, got top %d", top)
+	}
+
+	list.Select(450)
+	top, rows, _ = list.Visible(10)
+	if top != 441 || len(rows) != 10 || rows[9].ID != "email-450" || store.summaries != 2 {
+		t.Errorf("Expected a new window around email-450, got top %d, %d rows, %d loads", top, len(rows), store.summaries)
+	}
+	list.Select(1000)
+	if list.Selected() != 499 {
+		t.Errorf("Expected the selection clamped to 499, got %d", list.Selected())
+	}
+
+	// Full emails are fetched once
+	list.Select(3)
+	for range 3 {
+		email, err := list.Current()
+		if err != nil || email.ID != "email-3" || len(email.Raw) == 0 {
+			t.Fatalf("Expected the full email-3, got %+v, %v", email, err)
+		}
+	}
+	if store.gets != 1 {
+		t.Errorf("Expected 1 Get, got %d", store.gets)
+	}
+
+	if err := list.MarkRead(); err != nil {
+		t.Fatalf("MarkRead failed: %v", err)
+	}
+	if err := list.ToggleStarred(); err != nil {
+		t.Fatalf("ToggleStarred failed: %v", err)
+	}
+	if summary, _ := list.Summary(3); !summary.Read || !summary.Starred {
+		t.Errorf("Expected the summary to be read and starred, got %+v", summary)
+	}
+	if email, _ := store.Get("email-3"); !email.Read || !email.Starred {
+		t.Errorf("Expected the stored email to be read and starred, got %+v", email)
+	}
+
+	filter, _ := ParseFilter("subject:\"Message 499\"", time.Now())
+	if err := list.SetFilter(filter); err != nil {
+		t.Fatalf("SetFilter failed: %v", err)
+	}
+	if _, rows, _ := list.Visible(10); list.Len() != 1 || len(rows) != 1 || rows[0].ID != "email-499" {
+		t.Errorf("Expected only email-499, got %d rows", list.Len())
+	}
+
+	if err := list.SetFilter(nil); err != nil {
+		t.Fatalf("SetFilter failed: %v", err)
+	}
+	list.Select(499)
+	store.Delete("email-0")
+	if err := list.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if list.Len() != 499 || list.Selected() != 498 {
+		t.Errorf("Expected the selection to follow the shorter list, got %d of %d", list.Selected(), list.Len())
+	}
+	if email, _ := list.Current(); email == nil || email.ID != "email-499" {
+		t.Errorf("Expected email-499 selected, got %+v", email)
+	}
+}
+
+func TestEmailListRendered(t *testing.T) {
+	list := NewEmailList(seedEmails(t, 1))
+	renders := 0
+	render := func() string {
+		renders++
+		return fmt.Sprintf("render %d", renders)
+	}
+
+	list.Rendered("email-0", "text", render)
+	if got := list.Rendered("email-0", "text", render); got != "render 1" {
+		t.Errorf("Expected the cached rendering, got %q", got)
+	}
+	if got := list.Rendered("email-0", "raw", render); got != "render 2" {
+		t.Errorf("Expected another mode to render again, got %q", got)
+	}
+
+	if err := list.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if got := list.Rendered("email-0", "text", render); got != "render 3" {
+		t.Errorf("Expected Reload to drop the cache, got %q", got)
+	}
+}
+
+// BenchmarkEmailListNavigation moves the cursor one row at a time, as the j
+// key does. The cost per move should not grow with the number of emails.
+func BenchmarkEmailListNavigation(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		store := seedEmails(b, n)
+		b.Run(fmt.Sprintf("emails=%d", n), func(b *testing.B) {
+			list := NewEmailList(store)
+			if err := list.Reload(); err != nil {
+				b.Fatalf("Reload failed: %v", err)
+			}
+			b.ResetTimer()
+			for i := range b.N {
+				list.Select(i % n)
+				if _, _, err := list.Visible(40); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := list.Current(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+	"golang.org/x/net/websocket"
+)
+
+// newEventsTest returns an API server and the store it serves.
+func newEventsTest(t *testing.T) (*httptest.Server, Store) {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := NewSQLiteStore(db)
+	server := httptest.NewServer(NewAPIServer(0, store).Handler())
+	// Registered before any stream is opened, so streams are closed first
+	t.Cleanup(server.Close)
+
+	return server, store
+}
+
+func TestEventStreamSSE(t *testing.T) {
+	server, store := newEventsTest(t)
+
+	resp := apiRequest(t, "GET", server.URL+"/api/events", nil)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", contentType)
+	}
+
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the stream")
+			return ""
+		}
+	}
+
+	// The comment is written once the stream is subscribed
+	if line := next(); line != ": connected" {
+		t.Fatalf("Expected the connected comment, got %q", line)
+	}
+	next()
+
+	raw := "Subject: Welcome\r\n\r\nHello"
+	if err := store.Save(parseEmail(raw, "app@example.com", []string{"alice@example.com"}, "welcome")); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if line := next(); line != "event: message" {
+		t.Fatalf("Expected a message event, got %q", line)
+	}
+	var event smtpd.Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(next(), "data: ")), &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if event.ID != "welcome" || event.From != "app@example.com" || len(event.To) != 1 || event.To[0] != "alice@example.com" ||
+		event.Subject != "Welcome" || event.Size != len(raw) {
+		t.Errorf("Unexpected message event %+v", event)
+	}
+	next()
+
+	apiRequest(t, "DELETE", server.URL+"/api/v1/messages/"+event.ID, nil)
+	if line := next(); line != "event: delete" {
+		t.Fatalf("Expected a delete event, got %q", line)
+	}
+	if line := next(); !strings.Contains(line, `"id":"`+event.ID+`"`) {
+		t.Errorf("Expected the deleted ID, got %q", line)
+	}
+	next()
+
+	apiRequest(t, "DELETE", server.URL+"/api/v1/messages", nil)
+	if line := next(); line != "event: clear" {
+		t.Fatalf("Expected a clear event, got %q", line)
+	}
+}
+
+func TestEventStreamWebSocket(t *testing.T) {
+	server, store := newEventsTest(t)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/events"
+
+	if _, err := websocket.Dial(wsURL, "", "http://evil.example.com"); err == nil {
+		t.Error("Expected connections from other origins to be rejected")
+	}
+
+	ws, err := websocket.Dial(wsURL, "", server.URL)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	// The handshake completes before the subscription exists, so retry
+	// until the first message is seen
+	events := make(chan smtpd.Event, 16)
+	go func() {
+		for {
+			var event smtpd.Event
+			if err := websocket.JSON.Receive(ws, &event); err != nil {
+				close(events)
+				return
+			}
+			events <- event
+		}
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		if err := store.Save(parseEmail("Subject: Ping\r\n\r\n", "", nil, smtpd.NewID())); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		select {
+		case event := <-events:
+			if event.Type != smtpd.EventMessage || event.Subject != "Ping" {
+				t.Errorf("Unexpected event %+v", event)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Timed out waiting for a WebSocket event")
+		}
+	}
+}
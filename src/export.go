@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// Export formats
+const (
+	FormatEML     = "eml"
+	FormatMbox    = "mbox"
+	FormatMaildir = "maildir"
+)
+
+// ExportEmails writes emails to dest in format: a directory of .eml files,
+// a single mbox file (appended to if it exists) or a Maildir tree. The raw
+// bytes received over SMTP are written unchanged, apart from the "From "
+// quoting mbox requires.
+func ExportEmails(emails []Email, format, dest string) error {
+	dest = expandHome(dest)
+
+	switch format {
+	case FormatEML:
+		if err := ensureDir(dest); err != nil {
+			return err
+		}
+		for _, email := range emails {
+			if err := writeEML(email, filepath.Join(dest, email.ID+".eml")); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatMbox:
+		if err := ensureDir(filepath.Dir(dest)); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		for _, email := range emails {
+			if _, err := f.Write(mboxEntry(email)); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		return f.Close()
+	case FormatMaildir:
+		for _, email := range emails {
+			if err := deliverMaildir(email, dest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown export format %q (expected eml, mbox or maildir)", format)
+}
+
+// ExportEmail writes a single email to path, choosing the format from it:
+// "*.eml" is written as a file, "*.mbox" is appended to, an existing Maildir
+// is delivered into, and any other path is used as a directory of .eml
+// files. It returns where the message was written.
+func ExportEmail(email Email, path string) (string, error) {
+	path = expandHome(path)
+
+	switch {
+	case strings.HasSuffix(path, ".eml"):
+		if err := ensureDir(filepath.Dir(path)); err != nil {
+			return "", err
+		}
+		return path, writeEML(email, path)
+	case strings.HasSuffix(path, ".mbox"):
+		return path, ExportEmails([]Email{email}, FormatMbox, path)
+	case isMaildir(path):
+		return path, ExportEmails([]Email{email}, FormatMaildir, path)
+	}
+	return filepath.Join(path, email.ID+".eml"), ExportEmails([]Email{email}, FormatEML, path)
+}
+
+// writeEML creates path with the raw message, refusing to overwrite.
+func writeEML(email Email, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(smtpd.RawSource(email.Email)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mboxEntry formats email as an mboxrd message: a "From " separator line,
+// the message with ">"-quoted "From " lines, and a blank line.
+func mboxEntry(email Email) []byte {
+	sender := email.From
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	date := email.CreatedAt
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+
+	raw := smtpd.RawSource(email.Email)
+	for len(raw) > 0 {
+		line := raw
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			line = raw[:i+1]
+		}
+		raw = raw[len(line):]
+
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			b.WriteByte('>')
+		}
+		b.Write(line)
+	}
+	if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverMaildir writes email into tmp and moves it to new, as Maildir
+// delivery requires, creating the tree if needed.
+func deliverMaildir(email Email, dir string) error {
+	if err := ensureMaildir(dir); err != nil {
+		return err
+	}
+	name := maildirName(time.Now(), email.ID)
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := writeEML(email, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "new", name))
+}
+
+func ensureMaildir(dir string) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := ensureDir(filepath.Join(dir, sub)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maildirName returns a unique Maildir file name for the email with id
+// delivered at t.
+func maildirName(t time.Time, id string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return fmt.Sprintf("%d.%s.%s", t.UnixNano(), id, hostname)
+}
+
+// runExport implements "lazysmtp export" and returns the exit code.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "Path to SQLite database (default: XDG data directory)")
+	maildir := fs.String("maildir", "", "Use this Maildir as the store instead of the SQLite database")
+	format := fs.String("format", FormatEML, "Output format: eml, mbox or maildir")
+	query := fs.String("query", "", `Only export emails matching this filter, e.g. "to:@acme.test after:1d"`)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: lazysmtp export [options] <destination>\n\n")
+		fmt.Fprintf(fs.Output(), "Writes emails to a directory of .eml files, an mbox file or a Maildir.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	dest := fs.Arg(0)
+
+	switch *format {
+	case FormatEML, FormatMbox, FormatMaildir:
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -format %q: expected eml, mbox or maildir\n", *format)
+		return 2
+	}
+
+	filter, err := ParseFilter(*query, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -query: %v\n", err)
+		return 2
+	}
+
+	if *dbPath == "" {
+		*dbPath = GetDefaultDBPath()
+	}
+	store, err := OpenStore(*dbPath, *maildir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	emails, err := store.List(filter, 0, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load emails: %v\n", err)
+		return 1
+	}
+
+	if err := ExportEmails(emails, *format, dest); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			err = fmt.Errorf("%w (refusing to overwrite)", err)
+		}
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Exported %d emails to %s\n", len(emails), dest)
+	return 0
+}
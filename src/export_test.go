@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func TestExportEML(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	email := parseEmail(multipartEmail, "sender@example.com", []string{"recipient@example.com"}, "abc")
+
+	if err := ExportEmails([]Email{email}, FormatEML, dir); err != nil {
+		t.Fatalf("ExportEmails failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "abc.eml"))
+	if err != nil {
+		t.Fatalf("Failed to read exported file: %v", err)
+	}
+	if string(data) != multipartEmail {
+		t.Error("Expected the exported file to contain the raw message unchanged")
+	}
+
+	if err := ExportEmails([]Email{email}, FormatEML, dir); err == nil {
+		t.Error("Expected exporting over an existing file to fail")
+	}
+}
+
+func TestExportMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.mbox")
+	first := parseEmail("Subject: One\r\n\r\nFrom here on\r\n>From quoted\r\n", "a@example.com", []string{"b@example.com"}, "one")
+	first.CreatedAt = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := parseEmail("Subject: Two\r\n\r\nBody", "", []string{"b@example.com"}, "two")
+	second.CreatedAt = first.CreatedAt
+
+	if err := ExportEmails([]Email{first}, FormatMbox, path); err != nil {
+		t.Fatalf("ExportEmails failed: %v", err)
+	}
+	if err := ExportEmails([]Email{second}, FormatMbox, path); err != nil {
+		t.Fatalf("ExportEmails failed to append: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read mbox: %v", err)
+	}
+	want := "From a@example.com Fri Jan  2 03:04:05 2026\n" +
+		"Subject: One\r\n\r\n>From here on\r\n>>From quoted\r\n\n" +
+		"From MAILER-DAEMON Fri Jan  2 03:04:05 2026\n" +
+		"Subject: Two\r\n\r\nBody\n\n"
+	if string(data) != want {
+		t.Errorf("Unexpected mbox contents:\n%q\nwant\n%q", data, want)
+	}
+}
+
+func TestExportMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	emails := []Email{
+		parseEmail(multipartEmail, "sender@example.com", nil, "one"),
+		parseEmail(multipartEmail, "sender@example.com", nil, "two"),
+	}
+
+	if err := ExportEmails(emails, FormatMaildir, dir); err != nil {
+		t.Fatalf("ExportEmails failed: %v", err)
+	}
+	if !isMaildir(dir) {
+		t.Fatal("Expected cur, new and tmp directories to be created")
+	}
+
+	delivered, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(delivered) != 2 {
+		t.Fatalf("Expected 2 messages in new, got %d", len(delivered))
+	}
+	if pending, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(pending) != 0 {
+		t.Errorf("Expected tmp to be empty after delivery, got %d files", len(pending))
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "new", delivered[0].Name()))
+	if string(data) != multipartEmail {
+		t.Error("Expected the delivered file to contain the raw message unchanged")
+	}
+}
+
+func TestExportEmailChoosesFormat(t *testing.T) {
+	dir := t.TempDir()
+	email := parseEmail(multipartEmail, "sender@example.com", nil, "abc")
+
+	maildir := filepath.Join(dir, "Maildir")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(maildir, sub), 0755); err != nil {
+			t.Fatalf("Failed to create Maildir: %v", err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{filepath.Join(dir, "bug.eml"), filepath.Join(dir, "bug.eml")},
+		{filepath.Join(dir, "bug.mbox"), filepath.Join(dir, "bug.mbox")},
+		{filepath.Join(dir, "exports"), filepath.Join(dir, "exports", "abc.eml")},
+		{maildir, maildir},
+	}
+
+	for _, tt := range tests {
+		written, err := ExportEmail(email, tt.path)
+		if err != nil {
+			t.Errorf("ExportEmail(%q) failed: %v", tt.path, err)
+			continue
+		}
+		if written != tt.want {
+			t.Errorf("ExportEmail(%q) wrote %q, want %q", tt.path, written, tt.want)
+		}
+		if _, err := os.Stat(written); err != nil {
+			t.Errorf("Expected %q to exist: %v", written, err)
+		}
+	}
+
+	if delivered, _ := os.ReadDir(filepath.Join(maildir, "new")); len(delivered) != 1 {
+		t.Errorf("Expected 1 message delivered to the Maildir, got %d", len(delivered))
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "bug.mbox")); !strings.HasPrefix(string(data), "From sender@example.com ") {
+		t.Errorf("Expected an mbox entry, got %q", data)
+	}
+}
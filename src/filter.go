@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Filter is a parsed email list query such as
+//
+//	to:@acme.test subject:"Invoice" after:1h has:attachment size>100k
+//
+// Terms are ANDed together. A leading "-" negates a term, and words without
+// a field are matched against the full-text index. A filter can be compiled
+// to SQL or evaluated against an email in memory.
+type Filter struct {
+	terms []filterTerm
+}
+
+// filterTerm is one condition of a Filter. Values are validated, and times
+// and sizes resolved, when the filter is parsed.
+type filterTerm struct {
+	field  string // empty for free text
+	op     string
+	value  string
+	quoted bool // free text given as an exact phrase
+	negate bool
+	time   time.Time
+	size   int64
+}
+
+var filterTermPattern = regexp.MustCompile(`^([a-z]+)(:|>=|<=|>|<)(.*)$`)
+
+// ParseFilter parses query. Relative times such as after:1h are resolved
+// against now.
+func ParseFilter(query string, now time.Time) (*Filter, error) {
+	tokens, err := tokenizeFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Filter{}
+	for _, token := range tokens {
+		var term filterTerm
+		if strings.HasPrefix(token, "-") && len(token) > 1 {
+			term.negate = true
+			token = token[1:]
+		}
+
+		if m := filterTermPattern.FindStringSubmatch(token); m != nil {
+			term.field, term.op, term.value = m[1], m[2], unquoteFilterValue(m[3])
+			err = parseFilterTerm(&term, now)
+		} else {
+			term.value = unquoteFilterValue(token)
+			term.quoted = strings.HasPrefix(token, `"`)
+			if strings.TrimSpace(term.value) == "" {
+				err = fmt.Errorf("empty search term")
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.terms = append(f.terms, term)
+	}
+	return f, nil
+}
+
+// SQL returns the WHERE condition on the emails table and its arguments. An
+// empty filter matches every email.
+func (f *Filter) SQL() (string, []any) {
+	if f.Empty() {
+		return "1", nil
+	}
+	var clauses []string
+	var args []any
+	for _, term := range f.terms {
+		clause, termArgs := term.sql()
+		if term.negate {
+			clause = "NOT (" + clause + ")"
+		}
+		clauses = append(clauses, clause)
+		args = append(args, termArgs...)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// Match reports whether email satisfies the filter, for stores without
+// SQL. It agrees with SQL, approximating the full-text index by matching
+// whole words case- and accent-insensitively.
+func (f *Filter) Match(email Email) bool {
+	if f.Empty() {
+		return true
+	}
+	for _, term := range f.terms {
+		if term.match(email) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// summaryOnly reports whether Match needs no more of an email than
+// Store.Summaries returns: the addresses, subject, date, source and flags.
+func (f *Filter) summaryOnly() bool {
+	if f.Empty() {
+		return true
+	}
+	for _, term := range f.terms {
+		switch term.field {
+		case "to", "subject", "after", "before", "source", "is":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Empty reports whether the filter matches every email.
+func (f *Filter) Empty() bool {
+	return f == nil || len(f.terms) == 0
+}
+
+// FreeTextTerms returns the words and phrases of query that are searched
+// for as text rather than as a field, for highlighting matches.
+func FreeTextTerms(query string) []string {
+	tokens, err := tokenizeFilter(query)
+	if err != nil {
+		return nil
+	}
+	var terms []string
+	for _, term := range tokens {
+		if strings.HasPrefix(term, "-") || filterTermPattern.MatchString(term) {
+			continue
+		}
+		if value := unquoteFilterValue(term); value != "" {
+			terms = append(terms, value)
+		}
+	}
+	return terms
+}
+
+// tokenizeFilter splits query on whitespace outside double quotes. Quotes
+// are kept so that field values can be told apart from free text.
+func tokenizeFilter(query string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuotes:
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in %q", query)
+	}
+	flush()
+	return tokens, nil
+}
+
+func unquoteFilterValue(value string) string {
+	return strings.ReplaceAll(value, `"`, "")
+}
+
+// parseFilterTerm checks the field, operator and value of term, resolving
+// times and sizes.
+func parseFilterTerm(term *filterTerm, now time.Time) error {
+	if term.field == "size" {
+		size, err := parseSize(term.value)
+		term.size = size
+		return err
+	}
+	if term.op != ":" {
+		return fmt.Errorf("%s does not support %q", term.field, term.op)
+	}
+	if term.value == "" {
+		return fmt.Errorf("%s: needs a value", term.field)
+	}
+
+	switch term.field {
+	case "from", "to", "subject", "body", "source":
+		return nil
+	case "after", "before":
+		t, err := parseFilterTime(term.value, now)
+		if err != nil {
+			return fmt.Errorf("%s: %w", term.field, err)
+		}
+		term.time = t
+		return nil
+	case "has":
+		switch term.value {
+		case "attachment", "attachments", "html", "tls", "auth":
+			return nil
+		}
+		return fmt.Errorf("has: expected attachment, html, tls or auth, got %q", term.value)
+	case "is":
+		switch term.value {
+		case "read", "unread", "starred":
+			return nil
+		}
+		return fmt.Errorf("is: expected read, unread or starred, got %q", term.value)
+	}
+	return fmt.Errorf("unknown filter field %q", term.field)
+}
+
+func (term filterTerm) sql() (string, []any) {
+	like := "%" + escapeLike(term.value) + "%"
+	switch term.field {
+	case "":
+		return `rowid IN (SELECT rowid FROM emails_fts WHERE emails_fts MATCH ?)`,
+			[]any{ftsPhrase(term.value, !term.quoted)}
+	case "from":
+		return `(from_address LIKE ? ESCAPE '\' OR EXISTS (
+			SELECT 1 FROM headers WHERE email_id = emails.id AND name = 'From' AND value LIKE ? ESCAPE '\'))`,
+			[]any{like, like}
+	case "to":
+		return `(to_address LIKE ? ESCAPE '\' OR EXISTS (
+			SELECT 1 FROM recipients WHERE email_id = emails.id AND address LIKE ? ESCAPE '\'))`,
+			[]any{like, like}
+	case "subject":
+		return `subject LIKE ? ESCAPE '\'`, []any{like}
+	case "body":
+		return `rowid IN (SELECT rowid FROM emails_fts WHERE emails_fts MATCH ?)`,
+			[]any{"body : " + ftsPhrase(term.value, false)}
+	case "after":
+		return `created_at >= ?`, []any{term.time.Unix()}
+	case "before":
+		return `created_at < ?`, []any{term.time.Unix()}
+	case "source":
+		return `source = ?`, []any{strings.ToLower(term.value)}
+	case "size":
+		switch term.op {
+		case ">", ">=", "<", "<=":
+			return "size " + term.op + " ?", []any{term.size}
+		}
+		return `size = ?`, []any{term.size}
+	}
+
+	switch term.value {
+	case "read":
+		return `read = 1`, nil
+	case "unread":
+		return `read = 0`, nil
+	case "starred":
+		return `starred = 1`, nil
+	case "html":
+		return `EXISTS (SELECT 1 FROM parts WHERE email_id = emails.id AND content_type = 'text/html')`, nil
+	case "tls":
+		return `COALESCE(tls_version, '') <> ''`, nil
+	case "auth":
+		return `COALESCE(auth_user, '') <> ''`, nil
+	}
+	return `EXISTS (SELECT 1 FROM attachments WHERE email_id = emails.id)`, nil
+}
+
+func (term filterTerm) match(email Email) bool {
+	contains := func(s string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(term.value))
+	}
+
+	switch term.field {
+	case "":
+		addresses, headers := searchFields(email)
+		for _, column := range []string{email.Subject, addresses, headers, email.TextBody()} {
+			if matchPhrase(column, term.value, !term.quoted) {
+				return true
+			}
+		}
+		return false
+	case "from":
+		return contains(email.From) || slices.ContainsFunc(email.Headers["From"], contains)
+	case "to":
+		return contains(email.To) || slices.ContainsFunc(smtpd.RecipientAddresses(email.Recipients), contains)
+	case "subject":
+		return contains(email.Subject)
+	case "body":
+		return matchPhrase(email.TextBody(), term.value, false)
+	case "after":
+		return email.CreatedAt.Unix() >= term.time.Unix()
+	case "before":
+		return email.CreatedAt.Unix() < term.time.Unix()
+	case "source":
+		return email.Source == strings.ToLower(term.value)
+	case "size":
+		size := int64(emailSize(email))
+		switch term.op {
+		case ">":
+			return size > term.size
+		case ">=":
+			return size >= term.size
+		case "<":
+			return size < term.size
+		case "<=":
+			return size <= term.size
+		}
+		return size == term.size
+	}
+
+	switch term.value {
+	case "read":
+		return email.Read
+	case "unread":
+		return !email.Read
+	case "starred":
+		return email.Starred
+	case "html":
+		return slices.ContainsFunc(email.Parts, func(p Part) bool { return p.ContentType == "text/html" })
+	case "tls":
+		return email.TLSVersion != ""
+	case "auth":
+		return email.AuthUser != ""
+	}
+	return len(email.Attachments) > 0
+}
+
+// ftsPhrase quotes value as an FTS5 phrase, optionally matching the last
+// word as a prefix.
+func ftsPhrase(value string, prefix bool) string {
+	phrase := `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+	if prefix {
+		phrase += "*"
+	}
+	return phrase
+}
+
+// ftsTokens splits text into words the way the full-text index does:
+// lowercased and with accents removed.
+func ftsTokens(text string) []string {
+	fold := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), cases.Fold(), norm.NFC)
+	folded, _, err := transform.String(fold, text)
+	if err != nil {
+		folded = strings.ToLower(text)
+	}
+	return strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// matchPhrase reports whether the words of phrase appear consecutively in
+// text, the last one optionally as a prefix.
+func matchPhrase(text, phrase string, prefix bool) bool {
+	want := ftsTokens(phrase)
+	if len(want) == 0 {
+		return false
+	}
+	words := ftsTokens(text)
+	for i := 0; i+len(want) <= len(words); i++ {
+		matched := true
+		for j, w := range want {
+			last := j == len(want)-1
+			if words[i+j] != w && !(last && prefix && strings.HasPrefix(words[i+j], w)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSize parses a byte count with an optional k, m or g suffix (powers
+// of 1024), e.g. 100k.
+func parseSize(value string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToLower(value), "b")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(v, "k"):
+		multiplier = 1024
+		v = strings.TrimSuffix(v, "k")
+	case strings.HasSuffix(v, "m"):
+		multiplier = 1024 * 1024
+		v = strings.TrimSuffix(v, "m")
+	case strings.HasSuffix(v, "g"):
+		multiplier = 1024 * 1024 * 1024
+		v = strings.TrimSuffix(v, "g")
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("size: invalid size %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+var filterDateLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// parseFilterTime accepts an age such as 30m, 1h, 2d or 1w, or an absolute
+// date or time in local time.
+func parseFilterTime(value string, now time.Time) (time.Time, error) {
+	if age, ok := parseAge(value); ok {
+		return now.Add(-age), nil
+	}
+	for _, layout := range filterDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected an age like 1h or a date like 2006-01-02, got %q", value)
+}
+
+// parseAge parses a whole number of seconds, minutes, hours, days or weeks,
+// e.g. 30m or 2d.
+func parseAge(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	unit := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}[value[len(value)-1]]
+	n, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || unit == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
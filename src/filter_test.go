@@ -0,0 +1,240 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func TestTokenizeFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", nil},
+		{"  invoice  ", []string{"invoice"}},
+		{`to:@acme.test subject:"Invoice 42"`, []string{"to:@acme.test", `subject:"Invoice 42"`}},
+		{`"reset link" -from:bot`, []string{`"reset link"`, "-from:bot"}},
+		{"size>100k\thas:attachment", []string{"size>100k", "has:attachment"}},
+	}
+
+	for _, tt := range tests {
+		got, err := tokenizeFilter(tt.query)
+		if err != nil {
+			t.Errorf("tokenizeFilter(%q) failed: %v", tt.query, err)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("tokenizeFilter(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []string{
+		`subject:"unterminated`,
+		"colour:red",
+		"subject:",
+		"subject>3",
+		"after:yesterday",
+		"before:1y",
+		"has:everything",
+		"is:deleted",
+		"size>lots",
+		"size>-1k",
+		`""`,
+	}
+
+	for _, query := range tests {
+		if _, err := ParseFilter(query, time.Now()); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded, want an error", query)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"512", 512},
+		{"512b", 512},
+		{"100k", 100 * 1024},
+		{"100KB", 100 * 1024},
+		{"1.5m", 1536 * 1024},
+		{"2MB", 2 * 1024 * 1024},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.value)
+		if err != nil {
+			t.Errorf("parseSize(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterTime(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"90s", now.Add(-90 * time.Second)},
+		{"30m", now.Add(-30 * time.Minute)},
+		{"1h", now.Add(-time.Hour)},
+		{"2d", now.Add(-48 * time.Hour)},
+		{"1w", now.Add(-7 * 24 * time.Hour)},
+		{"2026-03-01", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"2026-03-01T08:30", time.Date(2026, 3, 1, 8, 30, 0, 0, time.UTC)},
+		{"2026-03-01T08:30:00Z", time.Date(2026, 3, 1, 8, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFilterTime(tt.value, now)
+		if err != nil {
+			t.Errorf("parseFilterTime(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseFilterTime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFreeTextTerms(t *testing.T) {
+	got := FreeTextTerms(`to:@acme.test reset "new password" -spam size>1k`)
+	want := []string{"reset", "new password"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("FreeTextTerms = %q, want %q", got, want)
+	}
+}
+
+func TestFilterEmails(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "filter.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	memory := NewMemoryStore()
+	maildir, err := NewMaildirStore(filepath.Join(t.TempDir(), "Maildir"))
+	if err != nil {
+		t.Fatalf("NewMaildirStore failed: %v", err)
+	}
+
+	now := time.Now()
+	fixtures := []struct {
+		raw  string
+		from string
+		to   []string
+		id   string
+		age  time.Duration
+	}{
+		{multipartEmail, "billing@shop.test", []string{"alice@acme.test"}, "invoice", time.Minute},
+		{"From: Accounts <accounts@shop.test>\r\nTo: bob@example.com\r\nSubject: Reset your password\r\n\r\nClick the link to reset 50%_off.",
+			"bounce@shop.test", []string{"bob@example.com"}, "reset", 3 * time.Hour},
+		{"From: news@acme.test\r\nTo: list@acme.test\r\nSubject: Weekly news\r\n\r\n" + strings.Repeat("news ", 30000),
+			"news@acme.test", []string{"list@acme.test", "carol@example.com"}, "news", 72 * time.Hour},
+	}
+	for _, f := range fixtures {
+		email := parseEmail(f.raw, f.from, f.to, f.id)
+		email.Read = f.id == "reset"
+		email.Starred = f.id == "invoice"
+		if err := SaveEmail(db, email); err != nil {
+			t.Fatalf("SaveEmail failed: %v", err)
+		}
+		if _, err := db.Exec(`UPDATE emails SET created_at = ? WHERE id = ?`, now.Add(-f.age).Unix(), f.id); err != nil {
+			t.Fatalf("Failed to set created_at: %v", err)
+		}
+
+		email.CreatedAt = now.Add(-f.age)
+		if err := memory.Save(email); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		if err := maildir.Save(email); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"invoice", "reset", "news"}},
+		{"to:@acme.test", []string{"invoice", "news"}},
+		{"to:carol", []string{"news"}},
+		{"from:accounts", []string{"reset"}},
+		{"from:BILLING@shop.test", []string{"invoice"}},
+		{`subject:"Invoice"`, []string{"invoice"}},
+		{`subject:"your password"`, []string{"reset"}},
+		{"subject:50%", nil},
+		{"after:1h", []string{"invoice"}},
+		{"after:1d", []string{"invoice", "reset"}},
+		{"before:1d", []string{"news"}},
+		{"has:attachment", []string{"invoice"}},
+		{"has:html", []string{"invoice"}},
+		{"has:tls", nil},
+		{"is:unread", []string{"invoice", "news"}},
+		{"is:read", []string{"reset"}},
+		{"is:starred", []string{"invoice"}},
+		{"-is:starred", []string{"reset", "news"}},
+		{"size>100k", []string{"news"}},
+		{"size<=100k", []string{"invoice", "reset"}},
+		{"reset", []string{"reset"}},
+		{"pass", []string{"reset"}},
+		{"cafe", []string{"invoice"}},
+		{`"reset your"`, []string{"reset"}},
+		{`"reset you"`, nil},
+		{"body:click", []string{"reset"}},
+		{"body:weekly", nil},
+		{"-to:@acme.test", []string{"reset"}},
+		{"-has:attachment -size>100k", []string{"reset"}},
+		{`to:@acme.test subject:"Invoice" after:1h has:attachment size<100k`, []string{"invoice"}},
+		{`to:@acme.test subject:"Invoice" after:1h has:attachment size>100k`, nil},
+	}
+
+	stores := map[string]Store{"sqlite": NewSQLiteStore(db), "memory": memory, "maildir": maildir}
+	for name, store := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.query, func(t *testing.T) {
+				filter, err := ParseFilter(tt.query, time.Now())
+				if err != nil {
+					t.Fatalf("ParseFilter failed: %v", err)
+				}
+				emails, err := store.List(filter, 0, 0)
+				if err != nil {
+					t.Fatalf("List failed: %v", err)
+				}
+				var ids []string
+				for _, email := range emails {
+					ids = append(ids, email.ID)
+				}
+				if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+					t.Errorf("Expected %v, got %v", tt.want, ids)
+				}
+
+				summaries, err := store.Summaries(filter, 0, 0)
+				if err != nil {
+					t.Fatalf("Summaries failed: %v", err)
+				}
+				if got := emailIDs(summaries); got != strings.Join(tt.want, ",") {
+					t.Errorf("Expected summaries %v, got %s", tt.want, got)
+				}
+
+				count, err := store.Count(filter)
+				if err != nil {
+					t.Fatalf("Count failed: %v", err)
+				}
+				if count != len(tt.want) {
+					t.Errorf("Expected count %d, got %d", len(tt.want), count)
+				}
+			})
+		}
+	}
+}
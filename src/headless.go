@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// shutdownTimeout bounds how long open SMTP sessions may take to finish
+// once a shutdown signal is received.
+const shutdownTimeout = 10 * time.Second
+
+// runHeadless serves SMTP without the TUI until SIGINT or SIGTERM, logging
+// JSON events to stdout. The HTTP API is served alongside when api is
+// non-nil, and janitor enforces retention meanwhile. storeLocation names
+// the database or Maildir in the startup log. It returns the process exit
+// code.
+func runHeadless(server *smtpd.Server, api *APIServer, janitor *Janitor, storeLocation slog.Attr) int {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	server.SetLogger(logger)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	requestedPort := server.Port()
+	if err := server.Start(); err != nil {
+		logger.Error("failed to start smtp server", "port", server.Port(), "error", err)
+		return 1
+	}
+	if server.Port() != requestedPort {
+		logger.Warn("smtp port in use, using next free port", "requested_port", requestedPort, "port", server.Port())
+	}
+	logger.Info("smtp server started",
+		"port", server.Port(),
+		"smtps_port", server.TLSPort(),
+		"starttls", server.STARTTLS(),
+		"auth_required", server.AuthRequired() != nil,
+		storeLocation,
+	)
+
+	if api != nil {
+		if err := api.Start(); err != nil {
+			logger.Error("failed to start http api", "port", api.Port(), "error", err)
+			server.Stop()
+			return 1
+		}
+		defer api.Stop()
+		logger.Info("http api started", "port", api.Port())
+	}
+
+	janitor.Start(func(err error) {
+		logger.Error("cleanup failed", "error", err)
+	})
+	defer janitor.Stop()
+
+	sig := <-signals
+	logger.Info("shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("smtp server did not shut down cleanly", "error", err)
+		server.Stop()
+		return 1
+	}
+
+	logger.Info("stopped")
+	return 0
+}
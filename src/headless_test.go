@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func TestRunHeadlessExitsCleanlyOnSignal(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	// runHeadless logs to stdout
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	logs := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		logs <- string(out)
+	}()
+
+	store := NewMemoryStore()
+	server := smtpd.NewServer(port, Received(store))
+	code := make(chan int)
+	go func() {
+		code <- runHeadless(server, nil, NewJanitor(store, Retention{}, 0), slog.String("db", ":memory:"))
+	}()
+
+	// Wait for the greeting, so the listener is being served
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client, err := smtp.Dial(addr)
+		if err == nil {
+			client.Quit()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the server: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case c := <-code:
+		w.Close()
+		out := <-logs
+		if c != 0 {
+			t.Errorf("Expected exit code 0, got %d:\n%s", c, out)
+		}
+		if !strings.Contains(out, `"msg":"stopped"`) {
+			t.Errorf("Expected a stopped log line, got:\n%s", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for runHeadless to return")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// ImportPath imports the messages at path and returns how many were saved.
+// A Maildir imports its cur and new messages, any other directory its .eml
+// and .mbox files, and a file is read as mbox if it starts with a "From "
+// line and as a single message otherwise.
+func ImportPath(store Store, path string) (int, error) {
+	path = expandHome(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return importFile(store, path)
+	}
+
+	if isMaildir(path) {
+		count := 0
+		for _, sub := range []string{"cur", "new"} {
+			entries, err := os.ReadDir(filepath.Join(path, sub))
+			if err != nil {
+				return count, err
+			}
+			for _, entry := range entries {
+				if entry.Type().IsRegular() {
+					n, err := importFile(store, filepath.Join(path, sub, entry.Name()))
+					count += n
+					if err != nil {
+						return count, err
+					}
+				}
+			}
+		}
+		return count, nil
+	}
+
+	count := 0
+	err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(file))
+		if d.Type().IsRegular() && (ext == ".eml" || ext == ".mbox") {
+			n, err := importFile(store, file)
+			count += n
+			return err
+		}
+		return nil
+	})
+	return count, err
+}
+
+func importFile(store Store, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if start, _ := r.Peek(5); string(start) == "From " {
+		return importMbox(store, r)
+	}
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := importMessage(store, raw, ""); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return 1, nil
+}
+
+// importMbox reads an mboxrd (or plain mboxo) stream, undoing the ">From "
+// quoting added on export.
+func importMbox(store Store, r *bufio.Reader) (int, error) {
+	count := 0
+	var message bytes.Buffer
+	var sender string
+	inMessage := false
+
+	flush := func() error {
+		if !inMessage {
+			return nil
+		}
+		// The blank line before the next "From " line is the separator
+		raw := message.Bytes()
+		raw = bytes.TrimSuffix(raw, []byte("\n"))
+		if err := importMessage(store, raw, sender); err != nil {
+			return err
+		}
+		count++
+		message.Reset()
+		return nil
+	}
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if bytes.HasPrefix(line, []byte("From ")) {
+				if err := flush(); err != nil {
+					return count, err
+				}
+				sender = mboxSender(line)
+				inMessage = true
+			} else if inMessage {
+				if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+					line = line[1:]
+				}
+				message.Write(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, flush()
+}
+
+// mboxSender returns the envelope sender from an mbox "From " line.
+func mboxSender(line []byte) string {
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[1] == "MAILER-DAEMON" {
+		return ""
+	}
+	return fields[1]
+}
+
+// importMessage saves raw through the same parsing path as SMTP delivery.
+func importMessage(store Store, raw []byte, sender string) error {
+	sender, recipients := headerEnvelope(raw, sender)
+	email := smtpd.ParseEmail(string(raw), sender, recipients, smtpd.NewID())
+	return store.Save(Email{Email: email, Source: SourceImported})
+}
+
+// headerEnvelope stands in for a missing envelope: the sender comes from
+// Return-Path or From unless given, and the recipients from To, Cc and Bcc.
+func headerEnvelope(raw []byte, sender string) (string, []string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return sender, nil
+	}
+	if sender == "" {
+		sender = strings.Trim(msg.Header.Get("Return-Path"), "<> ")
+	}
+	if sender == "" {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			sender = addr.Address
+		}
+	}
+	var recipients []string
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		if list, err := msg.Header.AddressList(key); err == nil {
+			for _, addr := range list {
+				recipients = append(recipients, addr.Address)
+			}
+		}
+	}
+	return sender, recipients
+}
+
+// runImport implements "lazysmtp import" and returns the exit code.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "Path to SQLite database (default: XDG data directory)")
+	maildir := fs.String("maildir", "", "Use this Maildir as the store instead of the SQLite database")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: lazysmtp import [options] <path>...\n\n")
+		fmt.Fprintf(fs.Output(), "Imports .eml files, mbox files, Maildirs and directories of .eml/.mbox files.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if *dbPath == "" {
+		*dbPath = GetDefaultDBPath()
+	}
+	store, err := OpenStore(*dbPath, *maildir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	total := 0
+	for _, path := range fs.Args() {
+		count, err := ImportPath(store, path)
+		total += count
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Import of %s failed after %d emails: %v\n", path, count, err)
+			return 1
+		}
+	}
+	fmt.Printf("Imported %d emails\n", total)
+	return 0
+}
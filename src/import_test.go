@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func TestImportEML(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "import.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	path := filepath.Join(t.TempDir(), "invoice.eml")
+	if err := os.WriteFile(path, []byte(multipartEmail), 0644); err != nil {
+		t.Fatalf("Failed to write fixture: %v", err)
+	}
+
+	count, err := ImportPath(NewSQLiteStore(db), path)
+	if err != nil {
+		t.Fatalf("ImportPath failed: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected 1 email imported, got %d", count)
+	}
+
+	emails, err := GetAllEmails(db)
+	if err != nil {
+		t.Fatalf("GetAllEmails failed: %v", err)
+	}
+	email := emails[0]
+	if email.Source != SourceImported {
+		t.Errorf("Expected source %q, got %q", SourceImported, email.Source)
+	}
+	if email.From != "sender@example.com" {
+		t.Errorf("Expected sender from the From header, got %q", email.From)
+	}
+	if len(email.Recipients) != 1 || email.Recipients[0].Address != "recipient@example.com" {
+		t.Errorf("Expected recipients from the To header, got %+v", email.Recipients)
+	}
+	if string(email.Raw) != multipartEmail {
+		t.Error("Expected the raw message to be stored unchanged")
+	}
+	if len(email.Attachments) != 1 {
+		t.Errorf("Expected the attachment to be parsed, got %d", len(email.Attachments))
+	}
+
+	filter, _ := ParseFilter("source:imported", time.Now())
+	if n, _ := CountFilteredEmails(db, filter); n != 1 {
+		t.Errorf("Expected source:imported to match the imported email, got %d", n)
+	}
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	messages := []Email{
+		parseEmail(multipartEmail, "billing@example.com", []string{"recipient@example.com"}, "one"),
+		parseEmail("Subject: Quoting\r\n\r\nFrom the start\r\n>From quoted\r\n", "a@example.com", []string{"b@example.com"}, "two"),
+	}
+
+	for _, format := range []string{FormatEML, FormatMbox, FormatMaildir} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			dest := filepath.Join(dir, "export")
+			if format == FormatMbox {
+				dest += ".mbox"
+			}
+			if err := ExportEmails(messages, format, dest); err != nil {
+				t.Fatalf("ExportEmails failed: %v", err)
+			}
+
+			db, err := InitDB(filepath.Join(dir, "import.db"))
+			if err != nil {
+				t.Fatalf("InitDB failed: %v", err)
+			}
+			defer db.Close()
+
+			count, err := ImportPath(NewSQLiteStore(db), dest)
+			if err != nil {
+				t.Fatalf("ImportPath failed: %v", err)
+			}
+			if count != len(messages) {
+				t.Fatalf("Expected %d emails imported, got %d", len(messages), count)
+			}
+
+			emails, err := GetAllEmails(db)
+			if err != nil {
+				t.Fatalf("GetAllEmails failed: %v", err)
+			}
+			raws := map[string]bool{}
+			for _, email := range emails {
+				raws[string(email.Raw)] = true
+			}
+			for _, message := range messages {
+				if !raws[string(message.Raw)] {
+					t.Errorf("Expected %q to survive the round trip unchanged", message.Subject)
+				}
+			}
+
+			if format == FormatMbox {
+				for _, email := range emails {
+					if email.Subject == "Quoting" && email.From != "a@example.com" {
+						t.Errorf("Expected the envelope sender from the mbox From line, got %q", email.From)
+					}
+				}
+			}
+		})
+	}
+}
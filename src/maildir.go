@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// maildirInfo separates a Maildir file name from its flags.
+const maildirInfo = ":2,"
+
+// deliveredHeader ends the envelope block MaildirStore writes in front of
+// each message.
+const deliveredHeader = "X-Lazysmtp-Delivered"
+
+// maildirMtimeSlack is how long after a directory changes its modification
+// time is trusted to reveal further changes. Coarse file system clocks give
+// changes made within the same tick the same time.
+const maildirMtimeSlack = 2 * time.Second
+
+// MaildirStore keeps emails as files in a Maildir, so any mail client can
+// open them. Emails are delivered to new; flagging one moves it to cur,
+// where the S flag marks it read and F starred.
+//
+// Each file starts with Return-Path, Delivered-To and X-Lazysmtp-Delivered
+// headers recording the envelope, which are stripped again on load. Files
+// delivered by other programs take their envelope from the headers. Their
+// changes show up on the next List but are not published to subscribers.
+//
+// The sorted index of new and cur is kept until this store writes or the
+// directories' modification times change, so reads don't scan the Maildir.
+// It only holds summaries; Get, List and filters on the content read the
+// files again.
+type MaildirStore struct {
+	dir    string
+	mu     sync.Mutex
+	cache  map[string]maildirSummary // by file name without the flags
+	events *smtpd.Broadcaster
+
+	indexed bool
+	entries []maildirEntry // newest first
+	byID    map[string]int // positions in entries
+	mtimes  [2]time.Time   // of new and cur when indexed
+	scanned time.Time
+}
+
+// maildirEntry is a message file in new or cur.
+type maildirEntry struct {
+	path  string
+	base  string // file name without the flags
+	flags string
+	maildirSummary
+}
+
+// maildirSummary is what the index keeps of a message: the fields
+// Summaries returns, with the flags applied, and its size.
+type maildirSummary struct {
+	email Email
+	size  int
+}
+
+func summarizeMaildirEmail(email Email) maildirSummary {
+	size := emailSize(email)
+	email.Body = ""
+	email.Headers = nil
+	email.Parts = nil
+	email.Attachments = nil
+	email.Raw = nil
+	return maildirSummary{email: email, size: size}
+}
+
+// NewMaildirStore opens the Maildir at dir, creating it if needed.
+func NewMaildirStore(dir string) (*MaildirStore, error) {
+	dir = expandHome(dir)
+	if err := ensureMaildir(dir); err != nil {
+		return nil, err
+	}
+	return &MaildirStore{dir: dir, cache: map[string]maildirSummary{}, events: smtpd.NewBroadcaster()}, nil
+}
+
+// Save keeps email's CreatedAt if set, so tests can backdate emails.
+func (m *MaildirStore) Save(email Email) error {
+	if email.CreatedAt.IsZero() {
+		email.CreatedAt = time.Now()
+	}
+	if email.Source == "" {
+		email.Source = SourceSMTP
+	}
+
+	m.mu.Lock()
+	err := m.save(email)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.events.Publish(smtpd.MessageEvent(email.Email))
+	return nil
+}
+
+func (m *MaildirStore) save(email Email) error {
+	if _, err := m.load(); err != nil {
+		return err
+	}
+	if m.index(email.ID) >= 0 {
+		return fmt.Errorf("email %q already exists", email.ID)
+	}
+
+	base := maildirName(email.CreatedAt, email.ID)
+	dest := filepath.Join(m.dir, "new", base)
+	if email.Read || email.Starred {
+		dest = filepath.Join(m.dir, "cur", base+maildirInfo+maildirFlags("", email.Read, email.Starred))
+	}
+
+	tmp := filepath.Join(m.dir, "tmp", base)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(maildirEnvelope(email), smtpd.RawSource(email.Email)...))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	m.cache[base] = summarizeMaildirEmail(email)
+	m.indexed = false
+	return nil
+}
+
+// load returns the messages in new and cur, newest first. The directories
+// are only read again when the index is stale, and then only files not seen
+// before are parsed.
+func (m *MaildirStore) load() ([]maildirEntry, error) {
+	var mtimes [2]time.Time
+	for i, sub := range []string{"new", "cur"} {
+		info, err := os.Stat(filepath.Join(m.dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		mtimes[i] = info.ModTime()
+	}
+	if m.indexed && mtimes == m.mtimes && m.scanned.Sub(latestTime(mtimes[:])) > maildirMtimeSlack {
+		return m.entries, nil
+	}
+
+	scanned := time.Now()
+	var entries []maildirEntry
+	seen := map[string]bool{}
+	for _, sub := range []string{"new", "cur"} {
+		files, err := os.ReadDir(filepath.Join(m.dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !file.Type().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			entry := maildirEntry{path: filepath.Join(m.dir, sub, file.Name())}
+			entry.base, entry.flags, _ = strings.Cut(file.Name(), maildirInfo)
+
+			summary, ok := m.cache[entry.base]
+			if !ok {
+				email, err := readMaildirFile(entry.path, entry.base)
+				if errors.Is(err, fs.ErrNotExist) {
+					// Moved by another process since the directory was read
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				summary = summarizeMaildirEmail(email)
+				m.cache[entry.base] = summary
+			}
+			entry.maildirSummary = summary
+			entry.applyFlags(&entry.email)
+			seen[entry.base] = true
+			entries = append(entries, entry)
+		}
+	}
+
+	for base := range m.cache {
+		if !seen[base] {
+			delete(m.cache, base)
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b maildirEntry) int {
+		if c := b.email.CreatedAt.Compare(a.email.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(b.base, a.base)
+	})
+
+	m.byID = make(map[string]int, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		m.byID[entries[i].email.ID] = i
+	}
+	m.entries, m.mtimes, m.scanned, m.indexed = entries, mtimes, scanned, true
+	return entries, nil
+}
+
+// applyFlags sets the read and starred flags of email from the file name.
+func (entry maildirEntry) applyFlags(email *Email) {
+	email.Read = strings.ContainsRune(entry.flags, 'S')
+	email.Starred = strings.ContainsRune(entry.flags, 'F')
+}
+
+// read parses the message file of entry.
+func (entry maildirEntry) read() (Email, error) {
+	email, err := readMaildirFile(entry.path, entry.base)
+	entry.applyFlags(&email)
+	return email, err
+}
+
+// matches reports whether entry satisfies filter, reading the file unless
+// the summary is enough to tell. It returns the email it looked at, in full
+// if the file was read.
+func (entry maildirEntry) matches(filter *Filter) (Email, bool, error) {
+	if filter.summaryOnly() {
+		return entry.email, filter.Match(entry.email), nil
+	}
+	email, err := entry.read()
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed by another process since the index was loaded
+		return email, false, nil
+	}
+	return email, err == nil && filter.Match(email), err
+}
+
+// index returns the position of the email with id in the index last
+// loaded, or -1.
+func (m *MaildirStore) index(id string) int {
+	if i, ok := m.byID[id]; ok {
+		return i
+	}
+	return -1
+}
+
+func latestTime(times []time.Time) time.Time {
+	var latest time.Time
+	for _, t := range times {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+func (m *MaildirStore) Get(id string) (*Email, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	i := m.index(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	email, err := entries[i].read()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+func (m *MaildirStore) List(filter *Filter, offset, limit int) ([]Email, error) {
+	return m.list(filter, offset, limit, true)
+}
+
+func (m *MaildirStore) Summaries(filter *Filter, offset, limit int) ([]Email, error) {
+	return m.list(filter, offset, limit, false)
+}
+
+// list returns the emails matching filter, read in full if full is set.
+func (m *MaildirStore) list(filter *Filter, offset, limit int, full bool) ([]Email, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []Email
+	for _, entry := range entries {
+		email, ok, err := entry.matches(filter)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if full && filter.summaryOnly() {
+			email, err = entry.read()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		emails = append(emails, email)
+		if len(emails) == limit {
+			break
+		}
+	}
+	return emails, nil
+}
+
+func (m *MaildirStore) Count(filter *Filter) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries, err := m.load()
+	if err != nil || filter.Empty() {
+		return len(entries), err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		_, ok, err := entry.matches(filter)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MaildirStore) SetRead(id string, read bool) error {
+	return m.setFlags(id, func(email *Email) { email.Read = read })
+}
+
+func (m *MaildirStore) SetStarred(id string, starred bool) error {
+	return m.setFlags(id, func(email *Email) { email.Starred = starred })
+}
+
+// setFlags applies update to the email with id and moves its file to cur
+// with the matching flags.
+func (m *MaildirStore) setFlags(id string, update func(email *Email)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries, err := m.load()
+	if err != nil {
+		return err
+	}
+	i := m.index(id)
+	if i < 0 {
+		return nil
+	}
+
+	entry := entries[i]
+	email := entry.email
+	update(&email)
+	flags := maildirFlags(entry.flags, email.Read, email.Starred)
+	dest := filepath.Join(m.dir, "cur", entry.base+maildirInfo+flags)
+	if dest == entry.path {
+		return nil
+	}
+	m.indexed = false
+	return os.Rename(entry.path, dest)
+}
+
+func (m *MaildirStore) Delete(id string) error {
+	m.mu.Lock()
+	entries, err := m.load()
+	i := -1
+	if err == nil {
+		if i = m.index(id); i >= 0 {
+			err = m.remove(entries[i])
+		}
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if i >= 0 {
+		m.events.Publish(deleteEvent(id))
+	}
+	return nil
+}
+
+func (m *MaildirStore) remove(entry maildirEntry) error {
+	m.indexed = false
+	if err := os.Remove(entry.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	delete(m.cache, entry.base)
+	return nil
+}
+
+func (m *MaildirStore) DeleteMatching(filter *Filter) ([]string, error) {
+	var ids []string
+	m.mu.Lock()
+	entries, err := m.load()
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+		var ok bool
+		if _, ok, err = entry.matches(filter); ok {
+			if err = m.remove(entry); err == nil {
+				ids = append(ids, entry.email.ID)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		m.events.Publish(deleteEvent(id))
+	}
+	return ids, err
+}
+
+func (m *MaildirStore) Clear() error {
+	m.mu.Lock()
+	entries, err := m.load()
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+		err = m.remove(entry)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.events.Publish(clearEvent())
+	return nil
+}
+
+func (m *MaildirStore) Prune(retention Retention) ([]string, error) {
+	now := time.Now()
+	var ids []string
+	var running int64
+	m.mu.Lock()
+	entries, err := m.load()
+	for i, entry := range entries {
+		if err != nil {
+			break
+		}
+		running += int64(entry.size)
+		if !retention.keeps(i+1, running, entry.email.CreatedAt, now) {
+			if err = m.remove(entry); err == nil {
+				ids = append(ids, entry.email.ID)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		m.events.Publish(deleteEvent(id))
+	}
+	return ids, err
+}
+
+func (m *MaildirStore) Stats() (StoreStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries, err := m.load()
+	if err != nil {
+		return StoreStats{}, err
+	}
+
+	stats := StoreStats{Count: len(entries)}
+	for _, entry := range entries {
+		stats.Size += int64(entry.size)
+	}
+	return stats, nil
+}
+
+func (m *MaildirStore) Subscribe() *smtpd.Subscription {
+	return m.events.Subscribe()
+}
+
+func (m *MaildirStore) Close() error {
+	return nil
+}
+
+// maildirFlags returns flags with S and F set from read and starred,
+// keeping any other flags, in the ASCII order Maildir requires.
+func maildirFlags(flags string, read, starred bool) string {
+	set := []rune(strings.NewReplacer("S", "", "F", "").Replace(flags))
+	if read {
+		set = append(set, 'S')
+	}
+	if starred {
+		set = append(set, 'F')
+	}
+	slices.Sort(set)
+	return string(slices.Compact(set))
+}
+
+// maildirEnvelope returns the header block recording email's envelope,
+// with the same line endings as the message.
+func maildirEnvelope(email Email) []byte {
+	eol := "\n"
+	if bytes.Contains(smtpd.RawSource(email.Email), []byte("\r\n")) {
+		eol = "\r\n"
+	}
+
+	params := map[string]string{
+		"id":      email.ID,
+		"created": email.CreatedAt.Format(time.RFC3339Nano),
+		"source":  email.Source,
+	}
+	for key, value := range map[string]string{"tls": email.TLSVersion, "cipher": email.TLSCipher, "auth": email.AuthUser} {
+		if value != "" {
+			params[key] = value
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Return-Path: <%s>%s", email.From, eol)
+	for _, rcpt := range email.Recipients {
+		fmt.Fprintf(&b, "Delivered-To: %s%s", rcpt.Address, eol)
+	}
+	fmt.Fprintf(&b, "%s: %s%s", deliveredHeader, mime.FormatMediaType("lazysmtp", params), eol)
+	return b.Bytes()
+}
+
+// readMaildirFile parses the message at path. Without a lazySMTP envelope
+// block, base is used as the ID and the file's modification time as
+// CreatedAt.
+func readMaildirFile(path, base string) (Email, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Email{}, err
+	}
+
+	var sender string
+	var recipients []string
+	r := bufio.NewReader(bytes.NewReader(data))
+	for offset := 0; ; {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		offset += len(line)
+		name, value, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ": ")
+		switch name {
+		case "Return-Path":
+			sender = strings.Trim(value, "<>")
+			continue
+		case "Delivered-To":
+			recipients = append(recipients, value)
+			continue
+		case deliveredHeader:
+			if _, params, err := mime.ParseMediaType(value); err == nil {
+				id := params["id"]
+				if id == "" {
+					id = base
+				}
+				email := Email{Email: smtpd.ParseEmail(string(data[offset:]), sender, recipients, id)}
+				email.CreatedAt, _ = time.Parse(time.RFC3339Nano, params["created"])
+				email.Source = params["source"]
+				email.TLSVersion = params["tls"]
+				email.TLSCipher = params["cipher"]
+				email.AuthUser = params["auth"]
+				return email, nil
+			}
+		}
+		break
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Email{}, err
+	}
+	sender, recipients = headerEnvelope(data, "")
+	email := Email{Email: smtpd.ParseEmail(string(data), sender, recipients, base)}
+	email.CreatedAt = info.ModTime()
+	email.Source = SourceImported
+	return email, nil
+}
@@ -4,21 +4,50 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/awesome-gocui/gocui"
+	"github.com/mouayed/lazysmtp/smtpd"
 )
 
 var (
-	port   = flag.Int("port", 2525, "SMTP server port")
-	dbPath = flag.String("db", "", "Path to SQLite database (default: XDG data directory)")
+	port        = flag.Int("port", 2525, "SMTP server port")
+	autoPort    = flag.Bool("auto-port", false, "If the SMTP port is in use, fall back to the next free port")
+	dbPath      = flag.String("db", "", "Path to SQLite database, or :memory: to keep emails in memory only (default: XDG data directory)")
+	maildir     = flag.String("maildir", "", "Store emails in this Maildir instead of the SQLite database")
+	starttls    = flag.Bool("starttls", false, "Offer STARTTLS on the SMTP port")
+	smtpsPort   = flag.Int("smtps-port", 0, "Port for implicit TLS (SMTPS), e.g. 465 (default: disabled)")
+	tlsCert     = flag.String("tls-cert", "", "TLS certificate file (default: generated self-signed certificate)")
+	tlsKey      = flag.String("tls-key", "", "TLS private key file")
+	authCreds   = flag.String("auth", "", "Require SMTP AUTH with these credentials (username:password); by default any login is accepted")
+	httpPort    = flag.Int("http-port", 0, "Port for the web UI and Mailpit/MailHog compatible HTTP API, e.g. 8025 (default: disabled)")
+	httpHost    = flag.String("http-host", "127.0.0.1", "Interface for the web UI and HTTP API to listen on; empty for all interfaces")
+	blockRemote = flag.Bool("preview-block-remote", false, "Block remote images, styles and fonts in the browser preview and web UI")
+	maxEmails   = flag.Int("max-emails", 0, "Keep at most this many emails, deleting the oldest (default: unlimited)")
+	maxSize     = flag.String("max-size", "", "Keep at most this much email, e.g. 500m or 2g (default: unlimited)")
+	maxAge      = flag.String("max-age", "", "Delete emails older than this, e.g. 12h, 30d or 2w (default: unlimited)")
+	vacuumEvery = flag.String("vacuum-every", "", "VACUUM the SQLite database this often, e.g. 1d (default: never)")
+	headless    = flag.Bool("headless", false, "Run without the TUI, logging JSON events to stdout")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "wait":
+			os.Exit(runWait(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	dbPathToUse := *dbPath
@@ -26,34 +55,103 @@ func main() {
 		dbPathToUse = GetDefaultDBPath()
 	}
 
-	db, err := InitDB(dbPathToUse)
+	retention, err := ParseRetention(*maxEmails, *maxSize, *maxAge)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Invalid retention: %v", err)
+	}
+	var vacuumInterval time.Duration
+	if *vacuumEvery != "" {
+		var ok bool
+		if vacuumInterval, ok = parseAge(*vacuumEvery); !ok || vacuumInterval <= 0 {
+			log.Fatalf("Invalid -vacuum-every %q: expected an interval like 12h or 1d", *vacuumEvery)
+		}
 	}
-	defer db.Close()
 
-	emails, err := GetAllEmails(db)
+	store, err := OpenStore(dbPathToUse, *maildir)
 	if err != nil {
-		log.Printf("Warning: Failed to load emails from database: %v", err)
-		emails = []Email{}
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer store.Close()
+	janitor := NewJanitor(store, retention, vacuumInterval)
+	store = WithRetention(store, retention, janitor.report)
+
+	smtpServer := smtpd.NewServer(*port, Received(store))
+	smtpServer.EnablePortFallback(*autoPort)
+	if retention.MaxSize > 0 {
+		// Refuse what retention would delete straight away
+		smtpServer.SetMaxMessageBytes(min(retention.MaxSize, smtpd.DefaultMaxMessageBytes))
+	}
+
+	if *starttls || *smtpsPort != 0 {
+		tlsConfig, err := smtpd.LoadTLSConfig(*tlsCert, *tlsKey, GetDefaultTLSDir())
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		smtpServer.EnableTLS(tlsConfig, *starttls, *smtpsPort)
 	}
 
-	newEmailChan := make(chan struct{}, 100)
+	if *authCreds != "" {
+		creds, err := smtpd.ParseCredentials(*authCreds)
+		if err != nil {
+			log.Fatalf("Invalid -auth value: %v", err)
+		}
+		smtpServer.RequireAuth(creds)
+	}
+
+	var apiServer *APIServer
+	if *httpPort != 0 {
+		apiServer = NewAPIServer(*httpPort, store)
+		apiServer.SetHost(*httpHost)
+		apiServer.BlockRemoteContent(*blockRemote)
+	}
+
+	storeLocation := slog.String("db", dbPathToUse)
+	if *maildir != "" {
+		storeLocation = slog.String("maildir", expandHome(*maildir))
+	}
+
+	if *headless {
+		code := runHeadless(smtpServer, apiServer, janitor, storeLocation)
+		store.Close()
+		os.Exit(code)
+	}
+
+	list := NewEmailList(store)
+	if err := list.Reload(); err != nil {
+		log.Printf("Warning: Failed to load emails from database: %v", err)
+	}
 
 	state := &AppState{
-		SelectedEmailIndex: -1,
-		Emails:             emails,
-		SMTP:               NewSMTPServer(*port, db, newEmailChan),
-		DB:                 db,
-		NewEmailChan:       newEmailChan,
-		Mode:               "text",
-		ShowPopup:          false,
-		PopupScroll:        0,
+		List:         list,
+		SMTP:         smtpServer,
+		API:          apiServer,
+		Preview:      NewPreviewServer(*blockRemote),
+		Store:        store,
+		Retention:    retention,
+		Janitor:      janitor,
+		Mode:         "text",
+		DetailScroll: map[string]int{},
+		ShowPopup:    false,
+		PopupScroll:  0,
 	}
 
-	fmt.Printf("\n\x1b[0;36mDatabase path:\x1b[0m %s\n\n", dbPathToUse)
+	label := "Database path"
+	if *maildir != "" {
+		label = "Maildir path"
+	}
+	fmt.Printf("\n\x1b[0;36m%s:\x1b[0m %s\n\n", label, storeLocation.Value)
+
+	// Reload on every change, including deletions made over HTTP
+	updates := store.Subscribe()
+
+	// A failed start is shown in the server panel rather than aborting, so
+	// the stored emails can still be browsed
+	state.SMTP.Start()
 
-	if err := state.SMTP.Start(); err != nil {
+	if apiServer != nil {
+		if err := apiServer.Start(); err != nil {
+			log.Fatalf("Failed to start HTTP API on port %d: %v", apiServer.Port(), err)
+		}
 	}
 
 	g, err := gocui.NewGui(gocui.OutputNormal, true)
@@ -70,15 +168,30 @@ func main() {
 		log.Fatalf("Failed to set layout: %v", err)
 	}
 
+	janitor.Start(func(err error) {
+		g.Update(func(_g *gocui.Gui) error {
+			state.StatusMessage = "Cleanup failed: " + err.Error()
+			return updateServerInfo(_g, state)
+		})
+	})
+
 	go func() {
-		for range newEmailChan {
-			emails, _ := GetAllEmails(db)
-			state.Emails = emails
-			g.Update(func(_g *gocui.Gui) error {
-				updateEmailList(_g, state)
-				updateServerInfo(_g, state)
-				return nil
-			})
+		reload := func(_g *gocui.Gui) error {
+			state.List.Reload()
+			updateEmailList(_g, state)
+			updateServerInfo(_g, state)
+			return nil
+		}
+		for {
+			for event := range updates.Events {
+				g.Update(func(_g *gocui.Gui) error {
+					forgetScroll(state, event)
+					return reload(_g)
+				})
+			}
+			// Dropped for falling behind: subscribe again and catch up
+			updates = store.Subscribe()
+			g.Update(reload)
 		}
 	}()
 
@@ -98,6 +211,11 @@ func main() {
 
 func cleanup(g *gocui.Gui, state *AppState) {
 	state.SMTP.Stop()
+	if state.API != nil {
+		state.API.Stop()
+	}
+	state.Preview.Stop()
+	state.Janitor.Stop()
 	g.Close()
 	fmt.Print("\x1b[2J\x1b[H")
 }
@@ -117,11 +235,20 @@ func updateEmailList(g *gocui.Gui, state *AppState) error {
 	}
 	v.Clear()
 
-	emails, err := GetAllEmails(state.DB)
+	// Only the visible rows are drawn, so the view itself never scrolls
+	_, height := v.Size()
+	top, emails, err := state.List.Visible(height)
 	if err != nil {
 		return err
 	}
-	state.Emails = emails
+
+	v.Title = "Emails"
+	if state.Search != "" {
+		v.Title = fmt.Sprintf("Emails - /%s (%d)", state.Search, state.List.Len())
+	}
+	if selected := state.List.Selected(); selected >= 0 {
+		v.Title += fmt.Sprintf(" - %d of %d", selected+1, state.List.Len())
+	}
 
 	for i, email := range emails {
 		maxLen := 30
@@ -137,16 +264,60 @@ func updateEmailList(g *gocui.Gui, state *AppState) error {
 
 		dateStr := formatHumanDate(email.Date)
 
+		selected := top+i == state.List.Selected()
 		prefix := " "
-		if i == state.SelectedEmailIndex {
+		if selected {
 			prefix = ">"
-			fmt.Fprintf(v, "\x1b[0;34m%s %s | %s | %s\x1b[0m\n", prefix, to, subject, dateStr)
+		}
+		// Starred emails are marked with *, unread ones with •
+		marker := " "
+		if email.Starred {
+			marker = "*"
+		} else if !email.Read {
+			marker = "•"
+		}
+
+		if selected {
+			fmt.Fprintf(v, "\x1b[0;34m%s%s %s | %s | %s\x1b[0m\n", prefix, marker, to, subject, dateStr)
 		} else {
-			fmt.Fprintf(v, "%s %s | %s | %s\n", prefix, to, subject, dateStr)
+			fmt.Fprintf(v, "%s%s %s | %s | %s\n", prefix, marker, to, subject, dateStr)
 		}
 	}
 
-	return nil
+	return v.SetOrigin(0, 0)
+}
+
+// ansiPattern matches the SGR escapes of rendered HTML.
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// highlightMatches marks every case-insensitive occurrence of terms in text.
+func highlightMatches(text string, terms []string) string {
+	var quoted []string
+	for _, term := range terms {
+		if term = strings.Trim(term, `"`); term != "" {
+			quoted = append(quoted, regexp.QuoteMeta(term))
+		}
+	}
+	if len(quoted) == 0 {
+		return text
+	}
+	re := regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+	highlight := func(s string) string {
+		return re.ReplaceAllStringFunc(s, func(match string) string {
+			return "\x1b[30;43m" + match + "\x1b[0m"
+		})
+	}
+
+	// Leave the escapes of rendered HTML intact
+	var b strings.Builder
+	last := 0
+	for _, loc := range ansiPattern.FindAllStringIndex(text, -1) {
+		b.WriteString(highlight(text[last:loc[0]]))
+		b.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(highlight(text[last:]))
+	return b.String()
 }
 
 func truncateString(s string, maxLen int) string {
@@ -236,19 +407,57 @@ func updateServerInfo(g *gocui.Gui, state *AppState) error {
 	if state.SMTP.IsRunning() {
 		status = "Running"
 		statusColor = "\x1b[0;32m"
+	} else if err := state.SMTP.Err(); err != nil {
+		status = "Failed: " + smtpd.ListenErrorReason(err)
 	}
 
 	modeColor := "\x1b[0;33m"
-	if state.Mode == "html" {
+	switch state.Mode {
+	case "html":
 		modeColor = "\x1b[0;35m"
+	case "raw":
+		modeColor = "\x1b[0;34m"
 	}
 
 	fmt.Fprintf(v, "Status: %s%s\x1b[0m\n", statusColor, status)
 	fmt.Fprintf(v, "\x1b[0;36mPort:\x1b[0m %d\n", state.SMTP.Port())
-	fmt.Fprintf(v, "\x1b[0;36mEmails:\x1b[0m %d\n", len(state.Emails))
+	var tlsModes []string
+	if state.SMTP.STARTTLS() {
+		tlsModes = append(tlsModes, "STARTTLS")
+	}
+	if tlsPort := state.SMTP.TLSPort(); tlsPort != 0 {
+		tlsModes = append(tlsModes, fmt.Sprintf("SMTPS :%d", tlsPort))
+	}
+	if len(tlsModes) == 0 {
+		tlsModes = append(tlsModes, "off")
+	}
+	fmt.Fprintf(v, "\x1b[0;36mTLS:\x1b[0m %s\n", strings.Join(tlsModes, ", "))
+	authMode := "optional"
+	if creds := state.SMTP.AuthRequired(); creds != nil {
+		authMode = "required (" + creds.Username + ")"
+	}
+	fmt.Fprintf(v, "\x1b[0;36mAuth:\x1b[0m %s\n", authMode)
+	if state.API != nil {
+		fmt.Fprintf(v, "\x1b[0;36mWeb UI:\x1b[0m http://localhost:%d\n", state.API.Port())
+	}
+	fmt.Fprintf(v, "\x1b[0;36mEmails:\x1b[0m %d\n", state.List.Len())
+	if stats, err := state.Store.Stats(); err == nil {
+		storeSize := formatSize(int(stats.Size))
+		if stats.Disk > 0 {
+			storeSize += ", " + formatSize(int(stats.Disk)) + " on disk"
+		}
+		fmt.Fprintf(v, "\x1b[0;36mStore:\x1b[0m %d emails, %s\n", stats.Count, storeSize)
+	}
+	if state.Retention.Enabled() {
+		fmt.Fprintf(v, "\x1b[0;36mRetention:\x1b[0m %s\n", state.Retention)
+	}
 	fmt.Fprintf(v, "Mode: %s%s\x1b[0m\n", modeColor, state.Mode)
 	fmt.Fprintf(v, "\n\x1b[0;33m[SPACE]\x1b[0m Toggle Server")
 	fmt.Fprintf(v, "\n\x1b[0;33m[m]\x1b[0m Toggle Mode")
+	fmt.Fprintf(v, "\n\x1b[0;33m[r]\x1b[0m Raw Source")
+	if state.StatusMessage != "" {
+		fmt.Fprintf(v, "\n\n\x1b[0;90m%s\x1b[0m", state.StatusMessage)
+	}
 
 	return nil
 }
@@ -260,8 +469,11 @@ func updateMainView(g *gocui.Gui, state *AppState) error {
 	}
 	v.Clear()
 
-	if state.SelectedEmailIndex >= 0 && state.SelectedEmailIndex < len(state.Emails) {
-		email := state.Emails[state.SelectedEmailIndex]
+	email, err := state.List.Current()
+	if err != nil {
+		return err
+	}
+	if email != nil {
 		fmt.Fprintf(v, "\x1b[1;36mEmail Details:\x1b[0m\n")
 
 		emailRows := [][]string{
@@ -272,17 +484,81 @@ func updateMainView(g *gocui.Gui, state *AppState) error {
 			{"Date", email.Date},
 		}
 
-		if contentType := email.Headers["Content-Type"]; contentType != "" {
+		for i, rcpt := range email.Recipients {
+			label := ""
+			if i == 0 {
+				label = "Envelope To"
+			}
+			address := rcpt.Address
+			if rcpt.Bcc {
+				address += " (bcc)"
+			}
+			emailRows = append(emailRows, []string{label, address})
+		}
+
+		tlsInfo := "none"
+		if email.TLSVersion != "" {
+			tlsInfo = email.TLSVersion + ", " + email.TLSCipher
+		}
+		emailRows = append(emailRows, []string{"TLS", tlsInfo})
+
+		authInfo := "none"
+		if email.AuthUser != "" {
+			authInfo = email.AuthUser
+		}
+		emailRows = append(emailRows, []string{"Auth", authInfo})
+
+		if email.Source == SourceImported {
+			emailRows = append(emailRows, []string{"Source", "imported"})
+		}
+
+		if cc := email.Headers.Get("Cc"); cc != "" {
+			emailRows = append(emailRows, []string{"Cc", cc})
+		}
+
+		if contentType := email.Headers.Get("Content-Type"); contentType != "" {
 			emailRows = append(emailRows, []string{"Content-Type", contentType})
 		}
 
 		printTable(v, []string{"Field", "Value"}, emailRows, []int{15, 38})
 
-		var bodyContent string
-		if state.Mode == "text" {
-			bodyContent = htmlToText(email.Body)
-		} else {
-			bodyContent = email.Body
+		bodyContent := state.List.Rendered(email.ID, state.Mode+"\x00"+state.Search, func() string {
+			var body string
+			switch state.Mode {
+			case "text":
+				body = email.TerminalBody()
+			case "raw":
+				body = string(email.Raw)
+				if len(email.Raw) == 0 {
+					body = "(raw source was not recorded for this email)"
+				}
+			default:
+				body = email.HTMLBody()
+			}
+			if state.Search != "" {
+				body = highlightMatches(body, FreeTextTerms(state.Search))
+			}
+			return body
+		})
+
+		if len(email.Attachments) > 0 {
+			if state.SelectedAttachment >= len(email.Attachments) {
+				state.SelectedAttachment = 0
+			}
+			attachmentRows := make([][]string, 0, len(email.Attachments))
+			for i, attachment := range email.Attachments {
+				marker := fmt.Sprintf("  %d", i+1)
+				if i == state.SelectedAttachment {
+					marker = fmt.Sprintf("> %d", i+1)
+				}
+				name := attachment.Filename
+				if name == "" {
+					name = "(unnamed)"
+				}
+				attachmentRows = append(attachmentRows, []string{marker, name, attachment.ContentType, formatSize(attachment.Size)})
+			}
+			fmt.Fprintf(v, "\n\x1b[1;36mAttachments:\x1b[0m \x1b[0;90m[a] next  [s] save\x1b[0m\n")
+			printTable(v, []string{"#", "Filename", "Type", "Size"}, attachmentRows, []int{4, 24, 20, 9})
 		}
 
 		fmt.Fprintf(v, "\n\x1b[1;36mBody (%s mode):\x1b[0m\n%s\n", state.Mode, bodyContent)
@@ -292,7 +568,7 @@ func updateMainView(g *gocui.Gui, state *AppState) error {
 		fmt.Fprintf(v, "\x1b[0;36m•\x1b[0m Lightweight SMTP server for testing\n")
 		fmt.Fprintf(v, "\x1b[0;36m•\x1b[0m Capture and view emails in real-time\n")
 		fmt.Fprintf(v, "\x1b[0;36m•\x1b[0m HTML and text mode support\n")
-		fmt.Fprintf(v, "\x1b[0;36m•\x1b[0m SQLite database for persistence\n")
+		fmt.Fprintf(v, "\x1b[0;36m•\x1b[0m SQLite or Maildir storage\n")
 		fmt.Fprintf(v, "\x1b[0;36m•\x1b[0m Keyboard-driven TUI interface\n")
 		fmt.Fprintf(v, "\x1b[0;36m•\x1b[0m Perfect for development and testing\n")
 
@@ -301,11 +577,62 @@ func updateMainView(g *gocui.Gui, state *AppState) error {
 			{"j/k", "Navigate emails"},
 			{"ESC", "Go back to home"},
 			{"d", "Delete selected email"},
+			{"f", "Star / unstar email"},
+			{"/", "Filter emails"},
+			{"a / s", "Pick / save attachment"},
+			{"e", "Export email"},
+			{"o", "Preview HTML in browser"},
 			{"SPACE", "Toggle server"},
 			{"m", "Toggle text/html"},
+			{"r", "Toggle raw source"},
+			{"^d/^u PgDn/PgUp", "Scroll details"},
 			{"q / Ctrl+C", "Quit application"},
 		}, []int{15, 26})
 	}
 
-	return nil
+	return scrollMainView(v, state)
+}
+
+// scrollMainView restores the scroll position of the open email, clamped to
+// the content, and shows where it is in the view title.
+func scrollMainView(v *gocui.View, state *AppState) error {
+	id := openEmailID(state)
+	_, height := v.Size()
+	total := v.ViewLinesHeight()
+	offset := clampScroll(state.DetailScroll[id], total, height)
+	state.DetailScroll[id] = offset
+	state.DetailLines = total
+
+	v.Title = "lazySMTP"
+	if total > height {
+		last := min(offset+height, total)
+		v.Title = fmt.Sprintf("lazySMTP - lines %d-%d of %d (%d%%)", offset+1, last, total, last*100/total)
+	}
+	return v.SetOrigin(0, offset)
+}
+
+// clampScroll limits offset to the range a view height lines tall can
+// scroll through total lines.
+func clampScroll(offset, total, height int) int {
+	return max(min(offset, total-height), 0)
+}
+
+// forgetScroll drops the scroll positions of the emails event removes,
+// whichever part of lazySMTP removed them.
+func forgetScroll(state *AppState, event smtpd.Event) {
+	switch event.Type {
+	case smtpd.EventDelete:
+		delete(state.DetailScroll, event.ID)
+	case smtpd.EventClear:
+		clear(state.DetailScroll)
+	}
+}
+
+// openEmailID returns the ID of the email shown in the detail pane, or ""
+// for the home screen.
+func openEmailID(state *AppState) string {
+	if email, _ := state.List.Summary(state.List.Selected()); email != nil {
+		return email.ID
+	}
+	return ""
 }
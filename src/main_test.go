@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func TestHighlightMatches(t *testing.T) {
+	tests := []struct {
+		text  string
+		terms []string
+		want  string
+	}{
+		{"Reset your password", []string{"password"}, "Reset your \x1b[30;43mpassword\x1b[0m"},
+		{"Pass and PASS", []string{"pass"}, "\x1b[30;43mPass\x1b[0m and \x1b[30;43mPASS\x1b[0m"},
+		{"a.b", []string{"."}, "a\x1b[30;43m.\x1b[0mb"},
+		{"unchanged", nil, "unchanged"},
+		{"unchanged", []string{`""`}, "unchanged"},
+	}
+
+	for _, tt := range tests {
+		if got := highlightMatches(tt.text, tt.terms); got != tt.want {
+			t.Errorf("highlightMatches(%q, %q) = %q, want %q", tt.text, tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestForgetScroll(t *testing.T) {
+	state := &AppState{DetailScroll: map[string]int{"a": 3, "b": 5}}
+
+	forgetScroll(state, smtpd.MessageEvent(Email{ID: "b"}))
+	forgetScroll(state, smtpd.Event{Type: smtpd.EventDelete, ID: "a"})
+	if _, ok := state.DetailScroll["a"]; ok || state.DetailScroll["b"] != 5 {
+		t.Errorf("Expected only a to be forgotten, got %v", state.DetailScroll)
+	}
+
+	forgetScroll(state, smtpd.Event{Type: smtpd.EventClear})
+	if len(state.DetailScroll) != 0 {
+		t.Errorf("Expected every position to be forgotten, got %v", state.DetailScroll)
+	}
+}
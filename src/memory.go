@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// MemoryStore keeps emails in memory, filtering them with Filter.Match.
+// Everything is lost when the process exits.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	emails []Email // newest first
+	events *smtpd.Broadcaster
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{events: smtpd.NewBroadcaster()}
+}
+
+// Save keeps email's CreatedAt if set, so tests can backdate emails.
+func (m *MemoryStore) Save(email Email) error {
+	if email.CreatedAt.IsZero() {
+		email.CreatedAt = time.Now()
+	}
+	if email.Source == "" {
+		email.Source = SourceSMTP
+	}
+
+	m.mu.Lock()
+	if m.index(email.ID) >= 0 {
+		m.mu.Unlock()
+		return fmt.Errorf("email %q already exists", email.ID)
+	}
+	// Keep the list newest first; ties go to the latest saved
+	i, _ := slices.BinarySearchFunc(m.emails, email.CreatedAt, func(e Email, t time.Time) int {
+		return t.Compare(e.CreatedAt)
+	})
+	m.emails = slices.Insert(m.emails, i, email)
+	m.mu.Unlock()
+
+	m.events.Publish(smtpd.MessageEvent(email.Email))
+	return nil
+}
+
+// index returns the position of the email with id, or -1.
+func (m *MemoryStore) index(id string) int {
+	return slices.IndexFunc(m.emails, func(e Email) bool { return e.ID == id })
+}
+
+func (m *MemoryStore) Get(id string) (*Email, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i := m.index(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	email := m.emails[i]
+	return &email, nil
+}
+
+func (m *MemoryStore) List(filter *Filter, offset, limit int) ([]Email, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var emails []Email
+	for _, email := range m.emails {
+		if !filter.Match(email) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		emails = append(emails, email)
+		if len(emails) == limit {
+			break
+		}
+	}
+	return emails, nil
+}
+
+// Summaries returns full emails, which cost nothing extra in memory.
+func (m *MemoryStore) Summaries(filter *Filter, offset, limit int) ([]Email, error) {
+	return m.List(filter, offset, limit)
+}
+
+func (m *MemoryStore) Count(filter *Filter) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	count := 0
+	for _, email := range m.emails {
+		if filter.Match(email) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryStore) SetRead(id string, read bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.index(id); i >= 0 {
+		m.emails[i].Read = read
+	}
+	return nil
+}
+
+func (m *MemoryStore) SetStarred(id string, starred bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.index(id); i >= 0 {
+		m.emails[i].Starred = starred
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	i := m.index(id)
+	if i >= 0 {
+		m.emails = slices.Delete(m.emails, i, i+1)
+	}
+	m.mu.Unlock()
+
+	if i >= 0 {
+		m.events.Publish(deleteEvent(id))
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteMatching(filter *Filter) ([]string, error) {
+	var ids []string
+	m.mu.Lock()
+	m.emails = slices.DeleteFunc(m.emails, func(e Email) bool {
+		if filter.Match(e) {
+			ids = append(ids, e.ID)
+			return true
+		}
+		return false
+	})
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		m.events.Publish(deleteEvent(id))
+	}
+	return ids, nil
+}
+
+func (m *MemoryStore) Clear() error {
+	m.mu.Lock()
+	m.emails = nil
+	m.mu.Unlock()
+
+	m.events.Publish(clearEvent())
+	return nil
+}
+
+func (m *MemoryStore) Prune(retention Retention) ([]string, error) {
+	now := time.Now()
+	var ids []string
+	var running int64
+	position := 0
+	m.mu.Lock()
+	m.emails = slices.DeleteFunc(m.emails, func(e Email) bool {
+		position++
+		running += int64(emailSize(e))
+		if retention.keeps(position, running, e.CreatedAt, now) {
+			return false
+		}
+		ids = append(ids, e.ID)
+		return true
+	})
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		m.events.Publish(deleteEvent(id))
+	}
+	return ids, nil
+}
+
+func (m *MemoryStore) Stats() (StoreStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := StoreStats{Count: len(m.emails)}
+	for _, email := range m.emails {
+		stats.Size += int64(emailSize(email))
+	}
+	return stats, nil
+}
+
+func (m *MemoryStore) Subscribe() *smtpd.Subscription {
+	return m.events.Subscribe()
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
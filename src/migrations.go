@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// A migration upgrades the schema from version-1 to version. Migrations are
+// applied in order, each in its own transaction together with the
+// schema_version row recording it, so a failed upgrade leaves the database
+// at the last good version.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. Never edit or reorder an
+// entry once released; append a new one instead.
+//
+// The first few use IF NOT EXISTS because databases created before
+// versioning was introduced may already contain those tables.
+var migrations = []migration{
+	{1, "create emails table", execMigration(`
+	CREATE TABLE IF NOT EXISTS emails (
+		id TEXT PRIMARY KEY,
+		from_address TEXT NOT NULL,
+		to_address TEXT NOT NULL,
+		subject TEXT,
+		body TEXT,
+		date TEXT NOT NULL,
+		created_at INTEGER DEFAULT (strftime('%s', 'now'))
+	);
+	`)},
+	{2, "store envelope recipients", execMigration(`
+	CREATE TABLE IF NOT EXISTS recipients (
+		email_id TEXT NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		address TEXT NOT NULL,
+		bcc INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (email_id, position)
+	);
+	`)},
+	{3, "store MIME parts", execMigration(`
+	CREATE TABLE IF NOT EXISTS parts (
+		email_id TEXT NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		charset TEXT,
+		disposition TEXT,
+		filename TEXT,
+		content_id TEXT,
+		content BLOB,
+		PRIMARY KEY (email_id, position)
+	);
+	`)},
+	{4, "store attachment metadata", execMigration(`
+	CREATE TABLE IF NOT EXISTS attachments (
+		email_id TEXT NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		part_position INTEGER NOT NULL,
+		filename TEXT,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		content_id TEXT,
+		disposition TEXT,
+		PRIMARY KEY (email_id, position)
+	);
+	`)},
+	{5, "store headers and raw source", execMigration(`
+	CREATE TABLE IF NOT EXISTS headers (
+		email_id TEXT NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (email_id, position)
+	);
+
+	CREATE TABLE IF NOT EXISTS raw_messages (
+		email_id TEXT PRIMARY KEY REFERENCES emails(id) ON DELETE CASCADE,
+		data BLOB NOT NULL
+	);
+	`)},
+	{6, "index emails by arrival", execMigration(`
+	CREATE INDEX emails_created_at ON emails (created_at);
+	`)},
+	{7, "record TLS connection state", execMigration(`
+	ALTER TABLE emails ADD COLUMN tls_version TEXT;
+	ALTER TABLE emails ADD COLUMN tls_cipher TEXT;
+	`)},
+	{8, "record authenticated user", execMigration(`
+	ALTER TABLE emails ADD COLUMN auth_user TEXT;
+	`)},
+	// The index shares rowids with emails. Existing emails are indexed
+	// from their stored text parts; new ones get the decoded text body.
+	{9, "full-text search index", execMigration(`
+	CREATE VIRTUAL TABLE emails_fts USING fts5(
+		subject, addresses, headers, body,
+		tokenize = 'unicode61 remove_diacritics 2'
+	);
+
+	CREATE TRIGGER emails_fts_delete AFTER DELETE ON emails BEGIN
+		DELETE FROM emails_fts WHERE rowid = old.rowid;
+	END;
+
+	INSERT INTO emails_fts (rowid, subject, addresses, headers, body)
+	SELECT
+		emails.rowid,
+		COALESCE(subject, ''),
+		from_address || ' ' || to_address || ' ' ||
+			COALESCE((SELECT group_concat(address, ' ') FROM recipients WHERE email_id = emails.id), ''),
+		COALESCE((SELECT group_concat(name || ': ' || value, char(10)) FROM headers WHERE email_id = emails.id), ''),
+		COALESCE((
+			SELECT group_concat(CAST(content AS TEXT), char(10)) FROM parts
+			WHERE email_id = emails.id AND content_type LIKE 'text/%' AND COALESCE(disposition, '') <> 'attachment'
+		), body, '')
+	FROM emails;
+	`)},
+	{10, "record message size", execMigration(`
+	ALTER TABLE emails ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+
+	UPDATE emails SET size = COALESCE(
+		(SELECT length(data) FROM raw_messages WHERE email_id = emails.id),
+		length(CAST(body AS BLOB)),
+		0
+	);
+	`)},
+	{11, "record message source", execMigration(`
+	ALTER TABLE emails ADD COLUMN source TEXT NOT NULL DEFAULT 'smtp';
+	`)},
+	{12, "record read and starred state", execMigration(`
+	ALTER TABLE emails ADD COLUMN read INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE emails ADD COLUMN starred INTEGER NOT NULL DEFAULT 0;
+	`)},
+}
+
+func execMigration(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// migrate brings the schema up to the latest version.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at INTEGER DEFAULT (strftime('%s', 'now'))
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this version of lazysmtp supports (%d)", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_version (version, description) VALUES (?, ?)`, m.version, m.description)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SchemaVersion returns the version of the last applied migration, or 0 for
+// a database that has never been migrated.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version)
+	return int(version.Int64), err
+}
@@ -63,6 +63,12 @@ func GetDefaultDBPath() string {
 	return filepath.Join(dataPath, "lazysmtp.db")
 }
 
+// GetDefaultTLSDir returns where the generated self-signed certificate is
+// cached.
+func GetDefaultTLSDir() string {
+	return filepath.Join(configPath, "tls")
+}
+
 func ensureDir(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return os.MkdirAll(path, 0755)
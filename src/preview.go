@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// previewCSP never lets captured messages run scripts, as mail clients
+// don't either, and sandboxes them in an origin of their own so they cannot
+// reach the API; blockedCSP also keeps images, styles and fonts local.
+const (
+	previewCSP = "script-src 'none'; object-src 'none'; frame-src 'none'; form-action 'none'; sandbox allow-popups allow-popups-to-escape-sandbox"
+	blockedCSP = "default-src 'none'; img-src 'self' data:; style-src 'self' 'unsafe-inline' data:; font-src 'self' data:; media-src 'self' data:; form-action 'none'; sandbox allow-popups allow-popups-to-escape-sandbox"
+)
+
+var cidPattern = regexp.MustCompile(`(?i)\bcid:([^"'\s)>]+)`)
+
+// PreviewServer serves the HTML part of emails on an ephemeral local port so
+// they can be checked in a real browser. It starts on the first preview.
+type PreviewServer struct {
+	blockRemote bool
+
+	mu       sync.Mutex
+	emails   map[string]Email
+	server   *http.Server
+	listener net.Listener
+}
+
+func NewPreviewServer(blockRemote bool) *PreviewServer {
+	return &PreviewServer{
+		blockRemote: blockRemote,
+		emails:      map[string]Email{},
+	}
+}
+
+// Show makes email available for preview and returns its URL.
+func (p *PreviewServer) Show(email Email) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server == nil {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		p.listener = listener
+		p.server = &http.Server{
+			Handler:           p.Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go p.server.Serve(listener)
+	}
+
+	p.emails[email.ID] = email
+	return fmt.Sprintf("http://%s/preview/%s", p.listener.Addr(), url.PathEscape(email.ID)), nil
+}
+
+func (p *PreviewServer) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server != nil {
+		p.server.Close()
+		p.server = nil
+	}
+}
+
+func (p *PreviewServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /preview/{id}", p.handlePreview)
+	mux.HandleFunc("GET /preview/{id}/cid/{cid}", p.handleInline)
+	return mux
+}
+
+func (p *PreviewServer) email(id string) (Email, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	email, ok := p.emails[id]
+	return email, ok
+}
+
+func (p *PreviewServer) handlePreview(w http.ResponseWriter, r *http.Request) {
+	email, ok := p.email(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writePreview(w, email, "/preview/"+url.PathEscape(email.ID)+"/cid/", p.blockRemote)
+}
+
+func (p *PreviewServer) handleInline(w http.ResponseWriter, r *http.Request) {
+	email, ok := p.email(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeInlinePart(w, r, email, r.PathValue("cid"))
+}
+
+// writePreview writes the HTML part of email as a page, with cid: references
+// pointing below cidBase. Emails without HTML show their text.
+func writePreview(w http.ResponseWriter, email Email, cidBase string, blockRemote bool) {
+	var body string
+	if part, ok := email.BodyPart("text/html"); ok {
+		body = string(part.Content)
+	} else if len(email.Parts) == 0 && strings.Contains(email.Body, "<") {
+		// Emails stored before MIME parsing only kept the body
+		body = email.Body
+	} else {
+		body = "<pre>" + html.EscapeString(email.TextBody()) + "</pre>"
+	}
+
+	body = cidPattern.ReplaceAllStringFunc(body, func(match string) string {
+		return cidBase + url.PathEscape(unescapeCID(match[len("cid:"):]))
+	})
+
+	csp := previewCSP
+	if blockRemote {
+		csp = blockedCSP
+	}
+	w.Header().Set("Content-Security-Policy", csp)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, body)
+}
+
+// writeInlinePart writes the part of email with Content-ID cid.
+func writeInlinePart(w http.ResponseWriter, r *http.Request, email Email, cid string) {
+	for _, part := range email.Parts {
+		if part.ContentID != "" && strings.EqualFold(part.ContentID, cid) {
+			contentType := part.ContentType
+			if part.Charset != "" {
+				contentType += "; charset=utf-8"
+			}
+			setPartHeaders(w.Header(), contentType)
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write(part.Content)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// unescapeCID decodes a cid: URL, which percent-encodes the Content-ID.
+func unescapeCID(cid string) string {
+	if unescaped, err := url.PathUnescape(cid); err == nil {
+		return unescaped
+	}
+	return cid
+}
+
+// openBrowser opens url with the desktop's default browser.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("%s not found", cmd.Path)
+		}
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+const inlineImageEmail = "From: sender@example.com\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Subject: Newsletter\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/related; boundary=\"rel\"\r\n" +
+	"\r\n" +
+	"--rel\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p><img src=\"cid:logo%40example.com\"> <img src=\"https://cdn.example.com/banner.png\"></p>\r\n" +
+	"--rel\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-ID: <logo@example.com>\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0K\r\n" +
+	"--rel--\r\n"
+
+func previewGet(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestPreviewServesHTMLWithInlineImages(t *testing.T) {
+	preview := NewPreviewServer(false)
+	defer preview.Stop()
+
+	email := parseEmail(inlineImageEmail, "sender@example.com", []string{"recipient@example.com"}, "abc")
+	url, err := preview.Show(email)
+	if err != nil {
+		t.Fatalf("Show failed: %v", err)
+	}
+	if !strings.HasPrefix(url, "http://127.0.0.1:") {
+		t.Errorf("Expected a loopback URL, got %q", url)
+	}
+
+	resp, body := previewGet(t, url)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(body, `src="/preview/abc/cid/logo@example.com"`) {
+		t.Errorf("Expected the cid: reference to be rewritten, got %q", body)
+	}
+	if !strings.Contains(body, "https://cdn.example.com/banner.png") {
+		t.Errorf("Expected remote references to be kept, got %q", body)
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'none'") || strings.Contains(csp, "default-src") {
+		t.Errorf("Expected scripts blocked and remote resources allowed, got %q", csp)
+	}
+
+	resp, body = previewGet(t, strings.TrimSuffix(url, "/abc")+"/abc/cid/logo@example.com")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Expected the inline image, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if body != "\x89PNG\r\n" {
+		t.Errorf("Expected the decoded image content, got %q", body)
+	}
+
+	if resp, _ := previewGet(t, url+"/cid/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown Content-ID, got %d", resp.StatusCode)
+	}
+}
+
+func TestPreviewBlocksRemoteResources(t *testing.T) {
+	preview := NewPreviewServer(true)
+	defer preview.Stop()
+
+	url, err := preview.Show(parseEmail("Subject: Plain\r\n\r\n<b>not html</b>", "", nil, "plain"))
+	if err != nil {
+		t.Fatalf("Show failed: %v", err)
+	}
+
+	resp, body := previewGet(t, url)
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'none'") || !strings.Contains(csp, "img-src 'self' data:") {
+		t.Errorf("Expected remote resources to be blocked, got %q", csp)
+	}
+	if body != "<pre>&lt;b&gt;not html&lt;/b&gt;</pre>" {
+		t.Errorf("Expected the text part escaped in a <pre>, got %q", body)
+	}
+
+	if resp, _ := previewGet(t, strings.TrimSuffix(url, "plain")+"unknown"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an email that was not previewed, got %d", resp.StatusCode)
+	}
+}
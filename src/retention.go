@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// janitorInterval is how often the janitor enforces retention.
+const janitorInterval = time.Minute
+
+// Retention limits what a store keeps; the oldest emails go first. Zero
+// fields are unlimited.
+type Retention struct {
+	MaxCount int
+	MaxSize  int64 // total raw size in bytes
+	MaxAge   time.Duration
+}
+
+// ParseRetention reads the -max-emails, -max-size and -max-age values. Sizes
+// take k, m or g suffixes and ages s, m, h, d or w, as in filter queries;
+// empty strings are unlimited.
+func ParseRetention(maxCount int, maxSize, maxAge string) (Retention, error) {
+	if maxCount < 0 {
+		return Retention{}, fmt.Errorf("invalid -max-emails %d", maxCount)
+	}
+	retention := Retention{MaxCount: maxCount}
+	if maxSize != "" {
+		size, err := parseSize(maxSize)
+		if err != nil {
+			return Retention{}, fmt.Errorf("invalid -max-size %q", maxSize)
+		}
+		retention.MaxSize = size
+	}
+	if maxAge != "" {
+		age, ok := parseAge(maxAge)
+		if !ok || age < 0 {
+			return Retention{}, fmt.Errorf("invalid -max-age %q: expected an age like 12h or 30d", maxAge)
+		}
+		retention.MaxAge = age
+	}
+	return retention, nil
+}
+
+// Enabled reports whether r limits anything.
+func (r Retention) Enabled() bool {
+	return r.MaxCount > 0 || r.MaxSize > 0 || r.MaxAge > 0
+}
+
+// keeps reports whether an email stays within r, given its position
+// counting from 1 for the newest email and the total size of it and every
+// newer one.
+func (r Retention) keeps(position int, running int64, created, now time.Time) bool {
+	return (r.MaxCount <= 0 || position <= r.MaxCount) &&
+		(r.MaxSize <= 0 || running <= r.MaxSize) &&
+		(r.MaxAge <= 0 || !created.Before(now.Add(-r.MaxAge)))
+}
+
+func (r Retention) String() string {
+	var limits []string
+	if r.MaxCount > 0 {
+		limits = append(limits, fmt.Sprintf("%d emails", r.MaxCount))
+	}
+	if r.MaxSize > 0 {
+		limits = append(limits, formatSize(int(r.MaxSize)))
+	}
+	if r.MaxAge > 0 {
+		limits = append(limits, formatAge(r.MaxAge))
+	}
+	if len(limits) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// formatAge shows d in the largest whole unit parseAge accepts.
+func formatAge(d time.Duration) string {
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{{"w", 7 * 24 * time.Hour}, {"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}} {
+		if d >= unit.size && d%unit.size == 0 {
+			return fmt.Sprintf("%d%s", d/unit.size, unit.suffix)
+		}
+	}
+	return d.String()
+}
+
+// StoreStats describes how much a store holds.
+type StoreStats struct {
+	Count int
+	Size  int64 // total raw size of the emails
+	Disk  int64 // database file size, 0 when not applicable
+}
+
+// vacuumer is implemented by stores that can give free space back to the
+// file system.
+type vacuumer interface {
+	Vacuum() error
+}
+
+// retainedStore enforces the count and size limits as emails are saved, so
+// a burst of emails never overshoots them until the janitor's next run. Ages
+// are left to the janitor, since a new email cannot make others expire.
+type retainedStore struct {
+	Store
+	retention Retention
+	onError   func(error)
+
+	mu sync.Mutex
+	// stats estimates the store's contents since they were last read, so
+	// that Save only prunes once a limit is crossed. Deletions elsewhere
+	// make it high, which costs an extra prune at most.
+	stats *StoreStats
+}
+
+// WithRetention returns store enforcing retention at ingest time. Prunes
+// that fail are passed to onError, if set; the janitor retries them.
+func WithRetention(store Store, retention Retention, onError func(error)) Store {
+	if retention.MaxCount <= 0 && retention.MaxSize <= 0 {
+		return store
+	}
+	return &retainedStore{Store: store, retention: retention, onError: onError}
+}
+
+// Save refuses emails larger than the size limit, which would be deleted
+// as soon as they were stored, and prunes once a limit is crossed.
+func (s *retainedStore) Save(email Email) error {
+	size := int64(emailSize(email))
+	if s.retention.MaxSize > 0 && size > s.retention.MaxSize {
+		return fmt.Errorf("email of %s exceeds the %s retention limit", formatSize(int(size)), formatSize(int(s.retention.MaxSize)))
+	}
+	if err := s.Store.Save(email); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats != nil {
+		s.stats.Count++
+		s.stats.Size += size
+	} else if stats, err := s.Store.Stats(); err == nil {
+		s.stats = &stats
+	} else {
+		s.report(err)
+		return nil
+	}
+	if s.retention.keeps(s.stats.Count, s.stats.Size, time.Now(), time.Now()) {
+		return nil
+	}
+
+	s.stats = nil
+	if _, err := s.Store.Prune(s.retention); err != nil {
+		s.report(err)
+	}
+	return nil
+}
+
+func (s *retainedStore) report(err error) {
+	if s.onError != nil {
+		s.onError(fmt.Errorf("retention: %w", err))
+	}
+}
+
+// Janitor enforces retention on a store in the background and vacuums
+// SQLite databases on a schedule.
+type Janitor struct {
+	store       Store
+	retention   Retention
+	vacuumEvery time.Duration
+	stop        chan struct{}
+	done        chan struct{}
+
+	mu      sync.Mutex
+	onError func(error)
+}
+
+// NewJanitor returns a janitor for store. A zero retention or vacuumEvery
+// skips that job.
+func NewJanitor(store Store, retention Retention, vacuumEvery time.Duration) *Janitor {
+	return &Janitor{store: store, retention: retention, vacuumEvery: vacuumEvery}
+}
+
+// Start prunes the store once and then keeps running in the background
+// until Stop. onError, if set, is called with every failed run.
+func (j *Janitor) Start(onError func(error)) {
+	j.mu.Lock()
+	j.onError = onError
+	j.mu.Unlock()
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	go j.run()
+}
+
+func (j *Janitor) Stop() {
+	if j.stop == nil {
+		return
+	}
+	close(j.stop)
+	<-j.done
+	j.stop = nil
+}
+
+func (j *Janitor) run() {
+	defer close(j.done)
+
+	var prune, vacuum <-chan time.Time
+	if j.retention.Enabled() {
+		j.prune()
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		prune = ticker.C
+	}
+	store, ok := j.store.(vacuumer)
+	if ok && j.vacuumEvery > 0 {
+		ticker := time.NewTicker(j.vacuumEvery)
+		defer ticker.Stop()
+		vacuum = ticker.C
+	}
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-prune:
+			j.prune()
+		case <-vacuum:
+			if err := store.Vacuum(); err != nil {
+				j.report(fmt.Errorf("vacuum: %w", err))
+			}
+		}
+	}
+}
+
+func (j *Janitor) prune() {
+	if _, err := j.store.Prune(j.retention); err != nil {
+		j.report(fmt.Errorf("retention: %w", err))
+	}
+}
+
+// report passes err to the callback given to Start. Retention enforced at
+// ingest reports through it too, so it may be called from any goroutine.
+func (j *Janitor) report(err error) {
+	j.mu.Lock()
+	onError := j.onError
+	j.mu.Unlock()
+	if onError != nil {
+		onError(err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		count     int
+		size, age string
+		want      Retention
+		wantErr   bool
+	}{
+		{0, "", "", Retention{}, false},
+		{1000, "500m", "30d", Retention{1000, 500 * 1024 * 1024, 30 * 24 * time.Hour}, false},
+		{0, "2g", "", Retention{MaxSize: 2 * 1024 * 1024 * 1024}, false},
+		{0, "", "12h", Retention{MaxAge: 12 * time.Hour}, false},
+		{-1, "", "", Retention{}, true},
+		{0, "lots", "", Retention{}, true},
+		{0, "", "1 month", Retention{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRetention(tt.count, tt.size, tt.age)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRetention(%d, %q, %q) error = %v, wantErr %v", tt.count, tt.size, tt.age, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRetention(%d, %q, %q) = %+v, want %+v", tt.count, tt.size, tt.age, got, tt.want)
+		}
+	}
+
+	if s := (Retention{MaxCount: 100, MaxSize: 1024 * 1024, MaxAge: 14 * 24 * time.Hour}).String(); s != "100 emails, 1.0 MB, 2w" {
+		t.Errorf("Unexpected String() %q", s)
+	}
+}
+
+// saveAged saves e0 to e4 with 1000 byte bodies, each an hour older than
+// the one before.
+func saveAged(t *testing.T, store Store) int {
+	t.Helper()
+	now := time.Now()
+	size := 0
+	for i := 4; i >= 0; i-- {
+		raw := fmt.Sprintf("Subject: e%d\r\n\r\n%s", i, strings.Repeat("x", 1000))
+		email := parseEmail(raw, "app@example.com", []string{"user@example.com"}, fmt.Sprintf("e%d", i))
+		email.CreatedAt = now.Add(-time.Duration(i) * time.Hour)
+		if err := store.Save(email); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		size = len(raw)
+	}
+	return size
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention func(size int) Retention
+		kept      string
+	}{
+		{"unlimited", func(int) Retention { return Retention{} }, "e0,e1,e2,e3,e4"},
+		{"count", func(int) Retention { return Retention{MaxCount: 3} }, "e0,e1,e2"},
+		{"size", func(size int) Retention { return Retention{MaxSize: int64(size) * 5 / 2} }, "e0,e1"},
+		{"age", func(int) Retention { return Retention{MaxAge: 90 * time.Minute} }, "e0,e1"},
+		{"combined", func(int) Retention { return Retention{MaxCount: 4, MaxAge: 150 * time.Minute} }, "e0,e1,e2"},
+	}
+
+	for name, open := range storeOpeners {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				store := open(t)
+				defer store.Close()
+				size := saveAged(t, store)
+
+				sub := store.Subscribe()
+				defer sub.Close()
+				ids, err := store.Prune(tt.retention(size))
+				if err != nil {
+					t.Fatalf("Prune failed: %v", err)
+				}
+				for range ids {
+					if event := receiveEvent(t, sub); event.Type != smtpd.EventDelete {
+						t.Errorf("Expected a delete event, got %+v", event)
+					}
+				}
+
+				emails, _ := store.List(nil, 0, 0)
+				if emailIDs(emails) != tt.kept {
+					t.Errorf("Expected %s kept, got %s", tt.kept, emailIDs(emails))
+				}
+				if len(ids)+len(emails) != 5 {
+					t.Errorf("Expected the pruned IDs to account for the rest, got %v", ids)
+				}
+
+				stats, err := store.Stats()
+				if err != nil {
+					t.Fatalf("Stats failed: %v", err)
+				}
+				if stats.Count != len(emails) || stats.Size != int64(len(emails)*size) {
+					t.Errorf("Expected %d emails of %d bytes, got %+v", len(emails), size, stats)
+				}
+			})
+		}
+	}
+}
+
+// pruneCounter counts the prunes a store is asked for, failing them with
+// err if set.
+type pruneCounter struct {
+	Store
+	prunes int
+	err    error
+}
+
+func (s *pruneCounter) Prune(retention Retention) ([]string, error) {
+	s.prunes++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.Store.Prune(retention)
+}
+
+func TestWithRetention(t *testing.T) {
+	memory := NewMemoryStore()
+	for _, retention := range []Retention{{}, {MaxAge: time.Hour}} {
+		if WithRetention(memory, retention, nil) != Store(memory) {
+			t.Errorf("Expected no wrapper for %+v", retention)
+		}
+	}
+
+	counter := &pruneCounter{Store: memory}
+	var errs []error
+	store := WithRetention(counter, Retention{MaxCount: 3, MaxSize: 1500}, func(err error) { errs = append(errs, err) })
+	size := saveAged(t, store)
+	if emails, _ := memory.List(nil, 0, 0); emailIDs(emails) != "e0" {
+		t.Errorf("Expected the size limit to keep only e0, got %s", emailIDs(emails))
+	}
+
+	// Only saves that cross a limit prune
+	memory.Clear()
+	store = WithRetention(counter, Retention{MaxCount: 3}, nil)
+	counter.prunes = 0
+	saveAged(t, store)
+	if emails, _ := memory.List(nil, 0, 0); emailIDs(emails) != "e0,e1,e2" {
+		t.Errorf("Expected the count limit to keep e0 to e2, got %s", emailIDs(emails))
+	}
+	if counter.prunes != 2 {
+		t.Errorf("Expected the 4th and 5th saves to prune, got %d prunes", counter.prunes)
+	}
+
+	// An email over the size limit is refused rather than deleted on arrival
+	store = WithRetention(counter, Retention{MaxSize: int64(size) - 1}, nil)
+	raw := "Subject: Large\r\n\r\n" + strings.Repeat("x", size)
+	if err := store.Save(parseEmail(raw, "", nil, "large")); err == nil {
+		t.Error("Expected an email over the size limit to be refused")
+	}
+	if _, err := memory.Get("large"); err != ErrNotFound {
+		t.Errorf("Expected the refused email not to be stored, got %v", err)
+	}
+
+	if len(errs) > 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+	counter.err = errors.New("database is locked")
+	store = WithRetention(counter, Retention{MaxCount: 1}, func(err error) { errs = append(errs, err) })
+	if err := store.Save(parseEmail("Subject: More\r\n\r\n", "", nil, "more")); err != nil {
+		t.Errorf("Expected a failed prune not to fail the save, got %v", err)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "database is locked") {
+		t.Errorf("Expected the failed prune to be reported, got %v", errs)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "janitor.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	store := NewSQLiteStore(db)
+	saveAged(t, store)
+
+	// The first run happens as soon as the janitor starts
+	janitor := NewJanitor(store, Retention{MaxAge: 150 * time.Minute}, 10*time.Millisecond)
+	var errs []error
+	janitor.Start(func(err error) { errs = append(errs, err) })
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if count, _ := store.Count(nil); count == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the janitor to prune")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	janitor.Stop()
+	janitor.Stop()
+	if len(errs) > 0 {
+		t.Errorf("Unexpected janitor errors: %v", errs)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "vacuum.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	store := NewSQLiteStore(db)
+
+	body := strings.Repeat("lorem ipsum ", 10000)
+	for i := range 20 {
+		raw := fmt.Sprintf("Subject: Large %d\r\n\r\n%s", i, body)
+		if err := store.Save(parseEmail(raw, "", nil, fmt.Sprintf("large-%d", i))); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear failed: %v", err)
+	}
+
+	before, _ := store.Stats()
+	if err := store.Vacuum(); err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+	after, _ := store.Stats()
+	if after.Disk >= before.Disk || after.Count != 0 {
+		t.Errorf("Expected VACUUM to shrink the database, got %d then %d bytes", before.Disk, after.Disk)
+	}
+}
@@ -1,239 +0,0 @@
-package main
-
-import (
-	"database/sql"
-	"fmt"
-	"io"
-	"math/rand"
-	"net/mail"
-	"regexp"
-	"strings"
-	"time"
-
-	"github.com/emersion/go-smtp"
-)
-
-type Backend struct {
-	db     *sql.DB
-	notify chan struct{}
-}
-
-func NewBackend(db *sql.DB, notify chan struct{}) *Backend {
-	return &Backend{
-		db:     db,
-		notify: notify,
-	}
-}
-
-func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{db: bkd.db, notify: bkd.notify}, nil
-}
-
-type Session struct {
-	db     *sql.DB
-	notify chan struct{}
-	from   string
-	to     string
-	body   strings.Builder
-}
-
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	s.from = from
-	return nil
-}
-
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.to = to
-	return nil
-}
-
-func (s *Session) Data(r io.Reader) error {
-	_, err := io.Copy(&s.body, r)
-	if err != nil {
-		return err
-	}
-
-	id := generateID()
-	email := parseEmail(s.body.String(), s.from, s.to, id)
-
-	err = SaveEmail(s.db, email)
-	if s.notify != nil {
-		select {
-		case s.notify <- struct{}{}:
-		default:
-		}
-	}
-
-	return nil
-}
-
-func (s *Session) Reset() {
-	s.from = ""
-	s.to = ""
-	s.body.Reset()
-}
-
-func (s *Session) Logout() error {
-	return nil
-}
-
-type SMTPServer struct {
-	server  *smtp.Server
-	port    int
-	db      *sql.DB
-	notify  chan struct{}
-	running bool
-}
-
-func NewSMTPServer(port int, db *sql.DB, notify chan struct{}) *SMTPServer {
-	return &SMTPServer{
-		port:   port,
-		db:     db,
-		notify: notify,
-	}
-}
-
-func (s *SMTPServer) Start() error {
-	if s.running {
-		return nil
-	}
-
-	backend := NewBackend(s.db, s.notify)
-
-	s.server = smtp.NewServer(backend)
-	s.server.Addr = fmt.Sprintf(":%d", s.port)
-	s.server.Domain = "localhost"
-	s.server.ReadTimeout = 10 * time.Second
-	s.server.WriteTimeout = 10 * time.Second
-	s.server.MaxMessageBytes = 1024 * 1024
-	s.server.MaxRecipients = 50
-	s.server.AllowInsecureAuth = true
-
-	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != smtp.ErrServerClosed {
-		}
-	}()
-
-	s.running = true
-	return nil
-}
-
-func (s *SMTPServer) Stop() {
-	if s.server != nil && s.running {
-		s.server.Close()
-		s.running = false
-	}
-}
-
-func (s *SMTPServer) IsRunning() bool {
-	return s.running
-}
-
-func (s *SMTPServer) Port() int {
-	return s.port
-}
-
-func (s *SMTPServer) Toggle() error {
-	if s.IsRunning() {
-		s.Stop()
-		return nil
-	}
-	return s.Start()
-}
-
-func generateID() string {
-	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
-	b := make([]byte, 8)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
-	}
-	return string(b)
-}
-
-func extractSubject(body string) string {
-	lines := strings.Split(body, "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(strings.ToLower(line), "subject:") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) > 1 {
-				return strings.TrimSpace(parts[1])
-			}
-		}
-	}
-	return "(no subject)"
-}
-
-func parseEmail(rawEmail string, from string, to string, id string) Email {
-	// Try to parse using net/mail
-	msg, err := mail.ReadMessage(strings.NewReader(rawEmail))
-
-	if err != nil {
-		// Fallback to simple parsing if net/mail fails
-		return Email{
-			ID:      id,
-			From:    from,
-			To:      to,
-			Subject: extractSubject(rawEmail),
-			Body:    rawEmail,
-			Date:    time.Now().Format(time.RFC1123),
-			Headers: make(map[string]string),
-		}
-	}
-
-	// Extract body content
-	bodyBytes, err := io.ReadAll(msg.Body)
-	if err != nil {
-		bodyBytes = []byte("Error reading body")
-	}
-	body := string(bodyBytes)
-
-	// Extract headers
-	headers := make(map[string]string)
-	for key, values := range msg.Header {
-		if len(values) > 0 {
-			headers[key] = values[0]
-		}
-	}
-
-	// Get subject from headers
-	subject := msg.Header.Get("Subject")
-	if subject == "" {
-		subject = "(no subject)"
-	}
-
-	// Get date from headers, fallback to current time
-	date := time.Now().Format(time.RFC1123)
-	if dateHeader := headers["Date"]; dateHeader != "" {
-		date = dateHeader
-	}
-
-	return Email{
-		ID:      id,
-		From:    from,
-		To:      to,
-		Subject: subject,
-		Body:    body,
-		Date:    date,
-		Headers: headers,
-	}
-}
-
-func htmlToText(html string) string {
-	// Remove HTML tags
-	re := regexp.MustCompile(`<[^>]*>`)
-	text := re.ReplaceAllString(html, "")
-
-	// Replace multiple whitespace with single space
-	re = regexp.MustCompile(`\s+`)
-	text = re.ReplaceAllString(text, " ")
-
-	// Decode common HTML entities
-	text = strings.ReplaceAll(text, "&amp;", "&")
-	text = strings.ReplaceAll(text, "&lt;", "<")
-	text = strings.ReplaceAll(text, "&gt;", ">")
-	text = strings.ReplaceAll(text, "&quot;", "\"")
-	text = strings.ReplaceAll(text, "&apos;", "'")
-	text = strings.ReplaceAll(text, "&nbsp;", " ")
-
-	return strings.TrimSpace(text)
-}
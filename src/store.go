@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// ErrNotFound is returned by Store.Get for an unknown ID.
+var ErrNotFound = errors.New("email not found")
+
+// memoryDBPath is the -db value selecting an in-memory store, for tests and
+// throwaway runs.
+const memoryDBPath = ":memory:"
+
+// Store keeps the captured emails. It is the only way the TUI, the HTTP API
+// and the subcommands reach them. Every change is published to subscribers,
+// so each of them follows changes made by the others.
+type Store interface {
+	// Save adds an email. The SMTP server saves to a Store through
+	// Received.
+	Save(email Email) error
+	// Get returns the email with id, or ErrNotFound.
+	Get(id string) (*Email, error)
+	// List returns the emails matching filter, newest first, skipping the
+	// first offset. A nil filter matches every email and a limit of 0
+	// returns all of them.
+	List(filter *Filter, offset, limit int) ([]Email, error)
+	// Summaries is List for the email list: it may leave out everything but
+	// the ID, addresses, subject, date, source and flags.
+	Summaries(filter *Filter, offset, limit int) ([]Email, error)
+	// Count returns how many emails match filter.
+	Count(filter *Filter) (int, error)
+	// SetRead and SetStarred update the flags of the email with id.
+	// Unknown IDs are ignored.
+	SetRead(id string, read bool) error
+	SetStarred(id string, starred bool) error
+	// Delete removes the email with id. Unknown IDs are ignored.
+	Delete(id string) error
+	// DeleteMatching removes the emails matching filter and returns their
+	// IDs.
+	DeleteMatching(filter *Filter) ([]string, error)
+	// Clear removes every email.
+	Clear() error
+	// Prune deletes the oldest emails until the store is within retention
+	// and returns their IDs.
+	Prune(retention Retention) ([]string, error)
+	// Stats reports how much the store holds.
+	Stats() (StoreStats, error)
+	// Subscribe returns a subscription to the changes made from now on.
+	Subscribe() *smtpd.Subscription
+	Close() error
+}
+
+// Received adapts store to the SMTP server, which hands it the messages
+// it parsed, without any of the state store keeps.
+func Received(store Store) smtpd.Store {
+	return receivedStore{store}
+}
+
+type receivedStore struct {
+	store Store
+}
+
+func (r receivedStore) Save(email smtpd.Email) error {
+	return r.store.Save(Email{Email: email})
+}
+
+// OpenStore opens the Maildir store in maildir if set, and otherwise the
+// store at path: the SQLite database there, or an empty in-memory store for
+// ":memory:".
+func OpenStore(path, maildir string) (Store, error) {
+	if maildir != "" {
+		return NewMaildirStore(maildir)
+	}
+	if path == memoryDBPath {
+		return NewMemoryStore(), nil
+	}
+	db, err := InitDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLiteStore(db), nil
+}
+
+func deleteEvent(id string) smtpd.Event {
+	return smtpd.Event{Type: smtpd.EventDelete, ID: id, Time: time.Now()}
+}
+
+func clearEvent() smtpd.Event {
+	return smtpd.Event{Type: smtpd.EventClear, Time: time.Now()}
+}
+
+// SQLiteStore keeps emails in a SQLite database, which other lazySMTP
+// processes may share.
+type SQLiteStore struct {
+	db     *sql.DB
+	events *smtpd.Broadcaster
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db, events: smtpd.NewBroadcaster()}
+}
+
+func (s *SQLiteStore) Save(email Email) error {
+	if err := SaveEmail(s.db, email); err != nil {
+		return err
+	}
+	s.events.Publish(smtpd.MessageEvent(email.Email))
+	return nil
+}
+
+func (s *SQLiteStore) Get(id string) (*Email, error) {
+	email, err := GetEmailByID(s.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return email, err
+}
+
+func (s *SQLiteStore) List(filter *Filter, offset, limit int) ([]Email, error) {
+	return FilterEmails(s.db, filter, offset, limit)
+}
+
+func (s *SQLiteStore) Summaries(filter *Filter, offset, limit int) ([]Email, error) {
+	return FilterEmailSummaries(s.db, filter, offset, limit)
+}
+
+func (s *SQLiteStore) Count(filter *Filter) (int, error) {
+	return CountFilteredEmails(s.db, filter)
+}
+
+func (s *SQLiteStore) SetRead(id string, read bool) error {
+	return SetEmailRead(s.db, id, read)
+}
+
+func (s *SQLiteStore) SetStarred(id string, starred bool) error {
+	return SetEmailStarred(s.db, id, starred)
+}
+
+func (s *SQLiteStore) Delete(id string) error {
+	if err := DeleteEmail(s.db, id); err != nil {
+		return err
+	}
+	s.events.Publish(deleteEvent(id))
+	return nil
+}
+
+func (s *SQLiteStore) DeleteMatching(filter *Filter) ([]string, error) {
+	ids, err := DeleteFilteredEmails(s.db, filter)
+	for _, id := range ids {
+		s.events.Publish(deleteEvent(id))
+	}
+	return ids, err
+}
+
+func (s *SQLiteStore) Clear() error {
+	if err := DeleteAllEmails(s.db); err != nil {
+		return err
+	}
+	s.events.Publish(clearEvent())
+	return nil
+}
+
+func (s *SQLiteStore) Prune(retention Retention) ([]string, error) {
+	ids, err := PruneEmails(s.db, retention, time.Now())
+	for _, id := range ids {
+		s.events.Publish(deleteEvent(id))
+	}
+	return ids, err
+}
+
+func (s *SQLiteStore) Stats() (StoreStats, error) {
+	return GetStoreStats(s.db)
+}
+
+// Vacuum rebuilds the database file, giving the space of deleted emails
+// back to the file system.
+func (s *SQLiteStore) Vacuum() error {
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+func (s *SQLiteStore) Subscribe() *smtpd.Subscription {
+	return s.events.Subscribe()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
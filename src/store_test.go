@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func receiveEvent(t *testing.T, sub *smtpd.Subscription) smtpd.Event {
+	t.Helper()
+	select {
+	case event := <-sub.Events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return smtpd.Event{}
+	}
+}
+
+func emailIDs(emails []Email) string {
+	ids := make([]string, len(emails))
+	for i, email := range emails {
+		ids[i] = email.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+// storeOpeners open an empty store of every implementation.
+var storeOpeners = map[string]func(t *testing.T) Store{
+	"sqlite": func(t *testing.T) Store {
+		store, err := OpenStore(filepath.Join(t.TempDir(), "store.db"), "")
+		if err != nil {
+			t.Fatalf("OpenStore failed: %v", err)
+		}
+		return store
+	},
+	"memory": func(t *testing.T) Store {
+		store, err := OpenStore(memoryDBPath, "")
+		if err != nil {
+			t.Fatalf("OpenStore failed: %v", err)
+		}
+		if _, ok := store.(*MemoryStore); !ok {
+			t.Fatalf("Expected %q to open a MemoryStore, got %T", memoryDBPath, store)
+		}
+		return store
+	},
+	"maildir": func(t *testing.T) Store {
+		store, err := OpenStore("", filepath.Join(t.TempDir(), "Maildir"))
+		if err != nil {
+			t.Fatalf("OpenStore failed: %v", err)
+		}
+		return store
+	},
+}
+
+// TestStores runs the same checks against every Store implementation.
+func TestStores(t *testing.T) {
+	for name, open := range storeOpeners {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			sub := store.Subscribe()
+			defer sub.Close()
+
+			for _, id := range []string{"one", "two", "three"} {
+				raw := "Subject: Message " + id + "\r\n\r\nBody"
+				if err := store.Save(parseEmail(raw, "app@example.com", []string{id + "@example.com"}, id)); err != nil {
+					t.Fatalf("Save failed: %v", err)
+				}
+				if event := receiveEvent(t, sub); event.Type != smtpd.EventMessage || event.ID != id {
+					t.Errorf("Expected a message event for %s, got %+v", id, event)
+				}
+			}
+			if err := store.Save(parseEmail("Subject: Again\r\n\r\n", "", nil, "one")); err == nil {
+				t.Error("Expected saving a duplicate ID to fail")
+			}
+
+			email, err := store.Get("two")
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if email.Subject != "Message two" || len(email.Recipients) != 1 || email.Source != SourceSMTP {
+				t.Errorf("Unexpected email %+v", email)
+			}
+			if _, err := store.Get("missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+
+			if emails, _ := store.List(nil, 0, 0); emailIDs(emails) != "three,two,one" {
+				t.Errorf("Expected newest first, got %s", emailIDs(emails))
+			}
+			if emails, _ := store.List(nil, 1, 1); emailIDs(emails) != "two" {
+				t.Errorf("Expected the second page, got %s", emailIDs(emails))
+			}
+
+			if err := store.SetRead("one", true); err != nil {
+				t.Fatalf("SetRead failed: %v", err)
+			}
+			if err := store.SetStarred("one", true); err != nil {
+				t.Fatalf("SetStarred failed: %v", err)
+			}
+			if err := store.SetRead("one", false); err != nil {
+				t.Fatalf("SetRead failed: %v", err)
+			}
+			if email, _ := store.Get("one"); email.Read || !email.Starred {
+				t.Errorf("Expected one to be unread and starred, got read=%v starred=%v", email.Read, email.Starred)
+			}
+			if email, _ := store.Get("three"); email.Read || email.Starred {
+				t.Errorf("Expected three to be unread and unstarred, got read=%v starred=%v", email.Read, email.Starred)
+			}
+			if err := store.SetRead("missing", true); err != nil {
+				t.Errorf("Expected SetRead to ignore unknown IDs, got %v", err)
+			}
+
+			if err := store.Delete("two"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if event := receiveEvent(t, sub); event.Type != smtpd.EventDelete || event.ID != "two" {
+				t.Errorf("Expected a delete event, got %+v", event)
+			}
+
+			filter, _ := ParseFilter("to:three@", time.Now())
+			ids, err := store.DeleteMatching(filter)
+			if err != nil || len(ids) != 1 || ids[0] != "three" {
+				t.Fatalf("Expected three to be deleted, got %v, %v", ids, err)
+			}
+			receiveEvent(t, sub)
+			if count, _ := store.Count(nil); count != 1 {
+				t.Errorf("Expected 1 email left, got %d", count)
+			}
+
+			if err := store.Clear(); err != nil {
+				t.Fatalf("Clear failed: %v", err)
+			}
+			if event := receiveEvent(t, sub); event.Type != smtpd.EventClear {
+				t.Errorf("Expected a clear event, got %+v", event)
+			}
+			if count, _ := store.Count(nil); count != 0 {
+				t.Errorf("Expected no emails after Clear, got %d", count)
+			}
+		})
+	}
+}
+
+func TestMaildirStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	store, err := NewMaildirStore(dir)
+	if err != nil {
+		t.Fatalf("NewMaildirStore failed: %v", err)
+	}
+
+	raw := "From: app@example.com\r\nTo: alice@example.com\r\nSubject: Welcome\r\n\r\nHello"
+	email := parseEmail(raw, "bounce@example.com", []string{"alice@example.com", "audit@example.com"}, "welcome")
+	email.TLSVersion = "TLS 1.3"
+	email.AuthUser = "app"
+	email.CreatedAt = time.Now().Add(-time.Minute)
+	if err := store.Save(email); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	files, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 message in new, got %d", len(files))
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if !strings.HasPrefix(string(data), "Return-Path: <bounce@example.com>\r\nDelivered-To: alice@example.com\r\nDelivered-To: audit@example.com\r\n") {
+		t.Errorf("Expected an envelope block, got %q", data)
+	}
+
+	if err := store.SetRead("welcome", true); err != nil {
+		t.Fatalf("SetRead failed: %v", err)
+	}
+	if err := store.SetStarred("welcome", true); err != nil {
+		t.Fatalf("SetStarred failed: %v", err)
+	}
+	files, _ = os.ReadDir(filepath.Join(dir, "cur"))
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ":2,FS") {
+		t.Fatalf("Expected one message in cur flagged FS, got %v", files)
+	}
+
+	// Another mail program files a message with its own flags
+	foreign := filepath.Join(dir, "cur", "1700000000.M1P1.host:2,RS")
+	if err := os.WriteFile(foreign, []byte("From: bob@example.com\nTo: carol@example.com\nSubject: Re: Hi\n\nThanks"), 0644); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if err := os.Chtimes(foreign, time.Now(), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	// A fresh store reads everything back from disk
+	reopened, err := NewMaildirStore(dir)
+	if err != nil {
+		t.Fatalf("NewMaildirStore failed: %v", err)
+	}
+	emails, err := reopened.List(nil, 0, 0)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if emailIDs(emails) != "welcome,1700000000.M1P1.host" {
+		t.Fatalf("Expected both messages newest first, got %s", emailIDs(emails))
+	}
+
+	got := emails[0]
+	if !got.Read || !got.Starred || got.From != "bounce@example.com" || len(got.Recipients) != 2 || !got.Recipients[1].Bcc {
+		t.Errorf("Unexpected email %+v", got)
+	}
+	if got.TLSVersion != "TLS 1.3" || got.AuthUser != "app" || got.Source != SourceSMTP || string(got.Raw) != raw {
+		t.Errorf("Expected the delivery details and raw source to round-trip, got %+v", got)
+	}
+	if !got.CreatedAt.Equal(email.CreatedAt) {
+		t.Errorf("Expected CreatedAt to be kept, got %v", got.CreatedAt)
+	}
+
+	other := emails[1]
+	if !other.Read || other.Starred || other.From != "bob@example.com" || other.Source != SourceImported {
+		t.Errorf("Unexpected foreign email %+v", other)
+	}
+	if err := reopened.SetStarred(other.ID, true); err != nil {
+		t.Fatalf("SetStarred failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur", "1700000000.M1P1.host:2,FRS")); err != nil {
+		t.Errorf("Expected other flags to be kept: %v", err)
+	}
+}
+
+func TestMaildirStoreIndex(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	store, err := NewMaildirStore(dir)
+	if err != nil {
+		t.Fatalf("NewMaildirStore failed: %v", err)
+	}
+	for _, id := range []string{"one", "two"} {
+		if err := store.Save(parseEmail("Subject: "+id+"\r\n\r\n", "app@example.com", nil, id)); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+
+	// Back in time, so the directories' modification times can be trusted
+	past := time.Now().Add(-time.Hour)
+	setDirTimes := func(at time.Time) {
+		for _, sub := range []string{"new", "cur"} {
+			os.Chtimes(filepath.Join(dir, sub), at, at)
+		}
+	}
+	setDirTimes(past)
+	if count, _ := store.Count(nil); count != 2 {
+		t.Fatalf("Expected 2 emails, got %d", count)
+	}
+
+	// A file slipped in without changing the times is not scanned for
+	foreign := filepath.Join(dir, "new", "1700000000.M1P1.host")
+	if err := os.WriteFile(foreign, []byte("Subject: three\n\n"), 0644); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	setDirTimes(past)
+	if count, _ := store.Count(nil); count != 2 {
+		t.Errorf("Expected the index to be reused, got %d emails", count)
+	}
+	setDirTimes(time.Now())
+	if count, _ := store.Count(nil); count != 3 {
+		t.Errorf("Expected the changed directory to be scanned, got %d emails", count)
+	}
+
+	if email, _ := store.Get("one"); email != nil {
+		email.Subject = "changed"
+	}
+	if email, _ := store.Get("one"); email == nil || email.Subject != "one" {
+		t.Errorf("Expected Get to return a copy, got %+v", email)
+	}
+
+	// Writes through the store invalidate the index
+	setDirTimes(past)
+	store.Count(nil)
+	if err := store.Delete("two"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	setDirTimes(past)
+	if emails, _ := store.List(nil, 0, 0); len(emails) != 2 || strings.Contains(emailIDs(emails), "two") {
+		t.Errorf("Expected two to be gone, got %s", emailIDs(emails))
+	}
+
+	// Only summaries stay in memory; full emails are read from the files
+	for _, entry := range store.entries {
+		if entry.email.Raw != nil || entry.email.Body != "" || entry.email.Parts != nil {
+			t.Errorf("Expected only a summary of %s in the index, got %+v", entry.email.ID, entry.email)
+		}
+	}
+	if summaries, _ := store.Summaries(nil, 0, 0); len(summaries) != 2 || summaries[0].Raw != nil {
+		t.Errorf("Expected summaries without the message, got %+v", summaries)
+	}
+	if email, _ := store.Get("one"); email == nil || !strings.Contains(string(email.Raw), "Subject: one") {
+		t.Errorf("Expected Get to read the whole message, got %+v", email)
+	}
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/awesome-gocui/gocui"
 )
@@ -57,6 +61,31 @@ func SetLayout(g *gocui.Gui, state *AppState) error {
 		v.SelFgColor = gocui.ColorDefault
 	}
 
+	if state.Prompt != nil {
+		if v, err := g.SetView("prompt", leftPanelWidth+3, maxY-5, maxX-3, maxY-3, 0); err != nil {
+			if err != gocui.ErrUnknownView {
+				return err
+			}
+			v.Editable = true
+			v.Wrap = false
+			v.FrameColor = gocui.ColorYellow
+			v.TitleColor = gocui.ColorYellow
+			v.Title = state.Prompt.Title
+			v.Editor = gocui.EditorFunc(func(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+				gocui.DefaultEditor.Edit(v, key, ch, mod)
+				promptChanged(g, state, v)
+			})
+			fmt.Fprint(v, state.Prompt.Value)
+			if err := v.SetCursor(len([]rune(state.Prompt.Value)), 0); err != nil {
+				return err
+			}
+		}
+	} else if _, err := g.View("prompt"); err == nil {
+		if err := g.DeleteView("prompt"); err != nil && err != gocui.ErrUnknownView {
+			return err
+		}
+	}
+
 	if state.ShowPopup {
 		if err := updatePopupView(g, state); err != nil {
 			return err
@@ -71,7 +100,11 @@ func SetLayout(g *gocui.Gui, state *AppState) error {
 				return err
 			}
 		}
-		_, err := g.SetCurrentView("main")
+		currentView := "main"
+		if state.Prompt != nil {
+			currentView = "prompt"
+		}
+		_, err := g.SetCurrentView(currentView)
 		if err != nil {
 			return err
 		}
@@ -128,7 +161,7 @@ func SetKeybindings(g *gocui.Gui, state *AppState) error {
 			}
 			return nil
 		}
-		state.SelectedEmailIndex = -1
+		state.List.Select(-1)
 		if err := updateEmailList(gui, state); err != nil {
 			return err
 		}
@@ -141,15 +174,8 @@ func SetKeybindings(g *gocui.Gui, state *AppState) error {
 	}
 
 	if err := g.SetKeybinding("", 'j', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
-		emails, _ := GetAllEmails(state.DB)
-		if len(emails) > 0 && state.SelectedEmailIndex < len(emails)-1 {
-			state.SelectedEmailIndex++
-			if err := updateEmailList(gui, state); err != nil {
-				return err
-			}
-			if err := updateMainView(gui, state); err != nil {
-				return err
-			}
+		if selected := state.List.Selected(); selected < state.List.Len()-1 {
+			return selectEmail(gui, state, selected+1)
 		}
 		return nil
 	}); err != nil {
@@ -157,14 +183,8 @@ func SetKeybindings(g *gocui.Gui, state *AppState) error {
 	}
 
 	if err := g.SetKeybinding("", 'k', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
-		if state.SelectedEmailIndex > 0 {
-			state.SelectedEmailIndex--
-			if err := updateEmailList(gui, state); err != nil {
-				return err
-			}
-			if err := updateMainView(gui, state); err != nil {
-				return err
-			}
+		if selected := state.List.Selected(); selected > 0 {
+			return selectEmail(gui, state, selected-1)
 		}
 		return nil
 	}); err != nil {
@@ -172,16 +192,18 @@ func SetKeybindings(g *gocui.Gui, state *AppState) error {
 	}
 
 	if err := g.SetKeybinding("", 'd', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
-		if state.SelectedEmailIndex >= 0 && state.SelectedEmailIndex < len(state.Emails) {
-			email := state.Emails[state.SelectedEmailIndex]
-			if err := DeleteEmail(state.DB, email.ID); err != nil {
+		email, err := state.List.Summary(state.List.Selected())
+		if err != nil {
+			return err
+		}
+		if email != nil {
+			id := email.ID
+			if err := state.Store.Delete(id); err != nil {
 				return err
 			}
-
-			emails, _ := GetAllEmails(state.DB)
-			state.Emails = emails
-			if state.SelectedEmailIndex >= len(emails) {
-				state.SelectedEmailIndex = len(emails) - 1
+			delete(state.DetailScroll, id)
+			if err := state.List.Reload(); err != nil {
+				return err
 			}
 
 			if err := updateEmailList(gui, state); err != nil {
@@ -200,9 +222,8 @@ func SetKeybindings(g *gocui.Gui, state *AppState) error {
 	}
 
 	if err := g.SetKeybinding("", gocui.KeySpace, gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
-		if err := state.SMTP.Toggle(); err != nil {
-			return err
-		}
+		// A bind failure is reported by updateServerInfo
+		state.SMTP.Toggle()
 		if err := updateServerInfo(gui, state); err != nil {
 			return err
 		}
@@ -228,6 +249,188 @@ func SetKeybindings(g *gocui.Gui, state *AppState) error {
 		return err
 	}
 
+	if err := g.SetKeybinding("", 'r', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		if state.Mode == "raw" {
+			state.Mode = "text"
+		} else {
+			state.Mode = "raw"
+		}
+		if err := updateServerInfo(gui, state); err != nil {
+			return err
+		}
+		if err := updateMainView(gui, state); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding("", 'f', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		if err := state.List.ToggleStarred(); err != nil {
+			return err
+		}
+		return updateEmailList(gui, state)
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding("", 'a', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		email, err := state.List.Current()
+		if email == nil || err != nil {
+			return err
+		}
+		attachments := email.Attachments
+		if len(attachments) == 0 {
+			return nil
+		}
+		state.SelectedAttachment = (state.SelectedAttachment + 1) % len(attachments)
+		return updateMainView(gui, state)
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding("", 's', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		email, err := state.List.Current()
+		if email == nil || err != nil {
+			return err
+		}
+		if state.SelectedAttachment >= len(email.Attachments) {
+			return nil
+		}
+		attachment := email.Attachments[state.SelectedAttachment]
+
+		return openPrompt(gui, state, &Prompt{
+			Title: "Save " + attachmentFilename(attachment) + " to directory",
+			Value: GetDefaultSaveDir(),
+			OnSubmit: func(gui *gocui.Gui, dir string) error {
+				path, err := SaveAttachment(*email, attachment, dir)
+				if err != nil {
+					state.StatusMessage = "Save failed: " + err.Error()
+				} else {
+					state.StatusMessage = "Saved " + path
+				}
+				return updateServerInfo(gui, state)
+			},
+		})
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding("", 'e', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		email, err := state.List.Current()
+		if email == nil || err != nil {
+			return err
+		}
+
+		return openPrompt(gui, state, &Prompt{
+			Title: "Export to .eml, .mbox, Maildir or directory",
+			Value: filepath.Join(GetDefaultSaveDir(), email.ID+".eml"),
+			OnSubmit: func(gui *gocui.Gui, path string) error {
+				written, err := ExportEmail(*email, path)
+				if err != nil {
+					state.StatusMessage = "Export failed: " + err.Error()
+				} else {
+					state.StatusMessage = "Exported to " + written
+				}
+				return updateServerInfo(gui, state)
+			},
+		})
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding("", 'o', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		email, err := state.List.Current()
+		if email == nil || err != nil {
+			return err
+		}
+		url, err := state.Preview.Show(*email)
+		if err != nil {
+			state.StatusMessage = "Preview failed: " + err.Error()
+		} else if err := openBrowser(url); err != nil {
+			state.StatusMessage = "Preview at " + url + " (could not open browser: " + err.Error() + ")"
+		} else {
+			state.StatusMessage = "Preview at " + url
+		}
+		return updateServerInfo(gui, state)
+	}); err != nil {
+		return err
+	}
+
+	scrollBindings := []struct {
+		key    interface{}
+		scroll func(page int) int
+	}{
+		{gocui.KeyCtrlD, func(page int) int { return page / 2 }},
+		{gocui.KeyCtrlU, func(page int) int { return -page / 2 }},
+		{gocui.KeyPgdn, func(page int) int { return page }},
+		{gocui.KeyPgup, func(page int) int { return -page }},
+		{'g', func(page int) int { return -math.MaxInt32 }},
+		{'G', func(page int) int { return math.MaxInt32 }},
+	}
+	for _, binding := range scrollBindings {
+		scroll := binding.scroll
+		if err := g.SetKeybinding("", binding.key, gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+			return scrollMain(gui, state, scroll)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := g.SetKeybinding("prompt", gocui.KeyEnter, gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		prompt := state.Prompt
+		value := strings.TrimSpace(v.Buffer())
+		if err := closePrompt(gui, state); err != nil {
+			return err
+		}
+		if prompt == nil || prompt.OnSubmit == nil || value == "" {
+			return nil
+		}
+		return prompt.OnSubmit(gui, value)
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding("prompt", gocui.KeyEsc, gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		prompt := state.Prompt
+		if err := closePrompt(gui, state); err != nil {
+			return err
+		}
+		if prompt != nil && prompt.OnCancel != nil {
+			prompt.OnCancel(gui)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// The global SPACE binding toggles the server, so typed spaces must be
+	// handled explicitly while the prompt is focused
+	if err := g.SetKeybinding("prompt", gocui.KeySpace, gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		v.EditWrite(' ')
+		promptChanged(gui, state, v)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := g.SetKeybinding("", '/', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
+		previous := state.Search
+		return openPrompt(gui, state, &Prompt{
+			Title: "Filter (e.g. to:@acme.test subject:\"Invoice\" after:1h has:attachment size>100k)",
+			Value: state.Search,
+			OnChange: func(gui *gocui.Gui, value string) {
+				setSearch(gui, state, value)
+			},
+			OnCancel: func(gui *gocui.Gui) {
+				setSearch(gui, state, previous)
+			},
+		})
+	}); err != nil {
+		return err
+	}
+
 	if err := g.SetKeybinding("", 'x', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
 		if state.ShowPopup {
 			state.ShowPopup = false
@@ -248,29 +451,11 @@ func SetKeybindings(g *gocui.Gui, state *AppState) error {
 	}
 
 	if err := g.SetKeybinding("popup", 'j', gocui.ModNone, func(gui *gocui.Gui, v *gocui.View) error {
-		keybindings := []struct {
-			key     string
-			action  string
-			context string
-		}{
-			{"x", "Open keybindings popup", "Always"},
-			{"j/k", "Navigate emails down/up", "Email list"},
-			{"j/k", "Scroll popup down/up", "Popup"},
-			{"ESC", "Go back to home / Close popup", "When viewing email / Popup"},
-			{"d", "Delete selected email", "Email list"},
-			{"SPACE", "Toggle SMTP server on/off", "Always"},
-			{"m", "Toggle text/html mode", "Always"},
-			{"q", "Quit / Close popup", "Always / Popup"},
-			{"Ctrl+C", "Quit / Close popup", "Always / Popup"},
-		}
-
 		popupView, err := gui.View("popup")
 		if err != nil {
 			return err
 		}
-		_, maxY := popupView.Size()
-		visibleLines := maxY - 6
-		maxScroll := len(keybindings) - visibleLines
+		maxScroll := len(popupKeybindings) - popupVisibleLines(popupView)
 
 		if maxScroll > 0 && state.PopupScroll < maxScroll {
 			state.PopupScroll++
@@ -298,6 +483,39 @@ func SetKeybindings(g *gocui.Gui, state *AppState) error {
 	return nil
 }
 
+// popupKeybindings is the list shown in the keybindings popup.
+var popupKeybindings = []struct {
+	key    string
+	action string
+}{
+	{"x", "Open / Close keybindings popup"},
+	{"j/k", "Navigate emails down/up"},
+	{"j/k", "Scroll popup down/up"},
+	{"ESC", "Go back to home / Close popup"},
+	{"d", "Delete selected email"},
+	{"f", "Star / Unstar selected email"},
+	{"/", "Filter emails"},
+	{"a", "Select next attachment"},
+	{"s", "Save selected attachment"},
+	{"e", "Export email (.eml, .mbox, Maildir)"},
+	{"o", "Preview HTML in browser"},
+	{"Ctrl+D/U", "Scroll details half a page"},
+	{"PgDn/PgUp", "Scroll details a page"},
+	{"g/G", "Jump to top/bottom of details"},
+	{"SPACE", "Toggle SMTP server on/off"},
+	{"m", "Toggle text/html mode"},
+	{"r", "Toggle raw source view"},
+	{"q", "Quit application / Close popup"},
+	{"Ctrl+C", "Quit application / Close popup"},
+}
+
+// popupVisibleLines returns how many keybindings fit in the popup above
+// the scroll position line.
+func popupVisibleLines(v *gocui.View) int {
+	_, maxY := v.Size()
+	return maxY - 4
+}
+
 func updatePopupView(g *gocui.Gui, state *AppState) error {
 	v, err := g.View("popup")
 	if err != nil {
@@ -305,32 +523,84 @@ func updatePopupView(g *gocui.Gui, state *AppState) error {
 	}
 	v.Clear()
 
-	keybindings := []struct {
-		key    string
-		action string
-	}{
-		{"x", "Open / Close keybindings popup"},
-		{"j/k", "Navigate emails down/up"},
-		{"j/k", "Scroll popup down/up"},
-		{"ESC", "Go back to home / Close popup"},
-		{"d", "Delete selected email"},
-		{"SPACE", "Toggle SMTP server on/off"},
-		{"m", "Toggle text/html mode"},
-		{"q", "Quit application / Close popup"},
-		{"Ctrl+C", "Quit application / Close popup"},
-	}
+	visibleLines := popupVisibleLines(v)
 
-	_, maxY := v.Size()
-	visibleLines := maxY - 4
-
-	for i := state.PopupScroll; i < len(keybindings) && i-state.PopupScroll < visibleLines; i++ {
-		kb := keybindings[i]
+	for i := state.PopupScroll; i < len(popupKeybindings) && i-state.PopupScroll < visibleLines; i++ {
+		kb := popupKeybindings[i]
 		fmt.Fprintf(v, "\x1b[0;33m%12s\x1b[0m  %s\n", kb.key, kb.action)
 	}
 
-	if len(keybindings) > visibleLines {
-		fmt.Fprintf(v, "\n\x1b[0;90mShowing %d-%d of %d keybindings\x1b[0m", state.PopupScroll+1, min(state.PopupScroll+visibleLines, len(keybindings)), len(keybindings))
+	if len(popupKeybindings) > visibleLines {
+		fmt.Fprintf(v, "\n\x1b[0;90mShowing %d-%d of %d keybindings\x1b[0m", state.PopupScroll+1, min(state.PopupScroll+visibleLines, len(popupKeybindings)), len(popupKeybindings))
 	}
 
 	return nil
 }
+
+// selectEmail moves the cursor to row i and opens the email there,
+// marking it read.
+func selectEmail(g *gocui.Gui, state *AppState, i int) error {
+	state.List.Select(i)
+	state.SelectedAttachment = 0
+	if err := state.List.MarkRead(); err != nil {
+		return err
+	}
+	if err := updateEmailList(g, state); err != nil {
+		return err
+	}
+	return updateMainView(g, state)
+}
+
+func openPrompt(g *gocui.Gui, state *AppState, prompt *Prompt) error {
+	state.Prompt = prompt
+	return SetLayout(g, state)
+}
+
+func closePrompt(g *gocui.Gui, state *AppState) error {
+	state.Prompt = nil
+	return SetLayout(g, state)
+}
+
+// scrollMain moves the detail pane by the number of lines step returns for
+// the pane height, stopping at either end of the content.
+func scrollMain(g *gocui.Gui, state *AppState, step func(page int) int) error {
+	v, err := g.View("main")
+	if err != nil {
+		return err
+	}
+	_, height := v.Size()
+	id := openEmailID(state)
+	state.DetailScroll[id] = clampScroll(state.DetailScroll[id]+step(height), state.DetailLines, height)
+	return updateMainView(g, state)
+}
+
+func promptChanged(g *gocui.Gui, state *AppState, v *gocui.View) {
+	if state.Prompt != nil && state.Prompt.OnChange != nil {
+		state.Prompt.OnChange(g, strings.TrimSpace(v.Buffer()))
+	}
+}
+
+// setSearch filters the email list with a filter query, keeping the
+// current list while the query does not parse.
+func setSearch(g *gocui.Gui, state *AppState, query string) {
+	if query == state.Search {
+		return
+	}
+	filter, err := ParseFilter(query, time.Now())
+	if err != nil {
+		state.StatusMessage = "Invalid filter: " + err.Error()
+		updateServerInfo(g, state)
+		return
+	}
+	if err := state.List.SetFilter(filter); err != nil {
+		state.StatusMessage = "Filter failed: " + err.Error()
+		updateServerInfo(g, state)
+		return
+	}
+	state.StatusMessage = ""
+	state.Search = query
+	state.SelectedAttachment = 0
+	updateEmailList(g, state)
+	updateMainView(g, state)
+	updateServerInfo(g, state)
+}
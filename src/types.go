@@ -1,26 +1,68 @@
 package main
 
 import (
-	"database/sql"
+	"time"
+
+	"github.com/awesome-gocui/gocui"
+	"github.com/mouayed/lazysmtp/smtpd"
 )
 
 type AppState struct {
-	SelectedEmailIndex int
-	Emails             []Email
-	SMTP               *SMTPServer
-	DB                 *sql.DB
-	NewEmailChan       chan struct{}
-	Mode               string // "text" or "html"
+	// List is the email list, narrowed down by Search.
+	List               *EmailList
+	SMTP               *smtpd.Server
+	API                *APIServer
+	Preview            *PreviewServer
+	Store              Store
+	Retention          Retention
+	Janitor            *Janitor
+	Mode               string // "text", "html" or "raw"
 	ShowPopup          bool
 	PopupScroll        int
+	SelectedAttachment int
+	Prompt             *Prompt
+	StatusMessage      string
+	Search             string // filter query for the email list
+	// DetailScroll is the scroll offset of the detail pane per email ID,
+	// so each message reopens where it was left.
+	DetailScroll map[string]int
+	// DetailLines is the line count of the detail pane when last drawn.
+	DetailLines int
+}
+
+// Prompt is a single-line input shown at the bottom of the screen.
+type Prompt struct {
+	Title    string
+	Value    string
+	OnSubmit func(g *gocui.Gui, value string) error
+	// OnChange, if set, is called after every edit.
+	OnChange func(g *gocui.Gui, value string)
+	// OnCancel, if set, is called when the prompt is closed with ESC.
+	OnCancel func(g *gocui.Gui)
 }
 
+// Email is a message as the store keeps it: what the SMTP server parsed,
+// and the state lazySMTP tracks for it.
 type Email struct {
-	ID      string
-	From    string
-	To      string
-	Subject string
-	Body    string
-	Date    string
-	Headers map[string]string
+	smtpd.Email
+	// CreatedAt is when the message was stored.
+	CreatedAt time.Time
+	// Source records how the message arrived: SourceSMTP or
+	// SourceImported.
+	Source  string
+	Read    bool
+	Starred bool
 }
+
+// Email sources
+const (
+	SourceSMTP     = "smtp"
+	SourceImported = "imported"
+)
+
+// The parts of a message are defined by the SMTP server package.
+type (
+	Recipient  = smtpd.Recipient
+	Part       = smtpd.Part
+	Attachment = smtpd.Attachment
+)
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// Poll intervals for "lazysmtp wait": the database is shared with another
+// process, so only polling sees its writes; the daemon pushes events, and
+// polling it only covers a dropped event stream.
+const (
+	waitDBPollInterval  = 200 * time.Millisecond
+	waitAPIPollInterval = 2 * time.Second
+)
+
+// emailFinder returns the newest matching email as JSON, or nil if there is
+// none yet.
+type emailFinder func(ctx context.Context) ([]byte, error)
+
+// waitForEmail calls find until it returns an email or ctx is done. It
+// retries after every poll interval and whenever changes fires.
+func waitForEmail(ctx context.Context, find emailFinder, changes <-chan struct{}, poll time.Duration) ([]byte, error) {
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		found, err := find(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if found != nil {
+			return found, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		case <-changes:
+		}
+	}
+}
+
+// waitQuery scopes query to the emails stored from start on, unless it
+// has an after: term of its own, and pins relative ages such as before:1m
+// to start. A running lazySMTP would otherwise resolve them again on every
+// poll, so both modes match the same emails. It reports whether the scope
+// was added.
+func waitQuery(query string, start time.Time) (string, bool, error) {
+	tokens, err := tokenizeFilter(query)
+	if err != nil {
+		return "", false, err
+	}
+
+	scoped := false
+	for i, token := range tokens {
+		negate := strings.HasPrefix(token, "-")
+		m := filterTermPattern.FindStringSubmatch(strings.TrimPrefix(token, "-"))
+		if m == nil || m[2] != ":" || (m[1] != "after" && m[1] != "before") {
+			continue
+		}
+		if m[1] == "after" && !negate {
+			scoped = true
+		}
+		if age, ok := parseAge(unquoteFilterValue(m[3])); ok {
+			tokens[i] = strings.TrimSuffix(token, m[3]) + start.Add(-age).Format(time.RFC3339)
+		}
+	}
+	if scoped {
+		return strings.Join(tokens, " "), false, nil
+	}
+	tokens = append(tokens, "after:"+start.Format(time.RFC3339))
+	return strings.Join(tokens, " "), true, nil
+}
+
+// waitSearch is a -query resolved for a wait starting at a given time.
+type waitSearch struct {
+	query  string
+	filter *Filter
+	// scoped is set if waitQuery limited the query to the wait. As that
+	// scope has whole-second precision, the emails it already matches when
+	// the wait starts were stored earlier in the same second and are
+	// skipped.
+	scoped bool
+}
+
+func parseWaitQuery(query string, start time.Time) (waitSearch, error) {
+	scoped, added, err := waitQuery(query, start)
+	if err != nil {
+		return waitSearch{}, err
+	}
+	filter, err := ParseFilter(scoped, start)
+	return waitSearch{query: scoped, filter: filter, scoped: added}, err
+}
+
+// storeFinder looks for emails matching filter in store, other than the
+// ones in skip.
+func storeFinder(store Store, filter *Filter, skip map[string]bool) emailFinder {
+	return func(ctx context.Context) ([]byte, error) {
+		emails, err := store.List(filter, 0, len(skip)+1)
+		if err != nil {
+			return nil, err
+		}
+		for _, email := range emails {
+			if !skip[email.ID] {
+				return json.Marshal(newMailpitMessage(email))
+			}
+		}
+		return nil, nil
+	}
+}
+
+// storeMatches returns the IDs of the emails matching filter in store.
+func storeMatches(store Store, filter *Filter) (map[string]bool, error) {
+	emails, err := store.List(filter, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		ids[email.ID] = true
+	}
+	return ids, nil
+}
+
+// apiFinder looks for emails matching query through the HTTP API of a
+// running lazySMTP at baseURL, other than the ones in skip.
+func apiFinder(client *http.Client, baseURL, query string, skip map[string]bool) emailFinder {
+	return func(ctx context.Context) ([]byte, error) {
+		ids, err := apiMatches(ctx, client, baseURL, query, len(skip)+1)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if skip[id] {
+				continue
+			}
+			var message json.RawMessage
+			err := apiGet(ctx, client, baseURL+"/api/v1/message/"+url.PathEscape(id), &message)
+			return message, err
+		}
+		return nil, nil
+	}
+}
+
+// apiMatches returns the IDs of up to limit emails matching query, newest
+// first, through the HTTP API of a running lazySMTP at baseURL.
+func apiMatches(ctx context.Context, client *http.Client, baseURL, query string, limit int) ([]string, error) {
+	var list struct {
+		Messages []struct{ ID string }
+	}
+	search := fmt.Sprintf("%s/api/v1/search?limit=%d&query=%s", baseURL, limit, url.QueryEscape(query))
+	if err := apiGet(ctx, client, search, &list); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(list.Messages))
+	for i, message := range list.Messages {
+		ids[i] = message.ID
+	}
+	return ids, nil
+}
+
+func apiGet(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// apiChanges follows the event stream of a running lazySMTP at baseURL and
+// fires whenever a message is saved. The channel is never closed; if the
+// stream ends, polling takes over.
+func apiChanges(ctx context.Context, client *http.Client, baseURL string) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/api/events", nil)
+	if err != nil {
+		return changes
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return changes
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return changes
+	}
+
+	go func() {
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() == "event: "+smtpd.EventMessage {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+// runWait implements "lazysmtp wait" and returns the exit code.
+func runWait(args []string) int {
+	fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "Path to SQLite database (default: XDG data directory)")
+	maildir := fs.String("maildir", "", "Use this Maildir as the store instead of the SQLite database")
+	apiURL := fs.String("url", "", "Wait through the HTTP API of a running lazySMTP instead, e.g. http://localhost:8025")
+	query := fs.String("query", "", `Filter the email must match, e.g. "to:alice@test subject:Welcome after:1m"`)
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait; 0 waits forever")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: lazysmtp wait [options]\n\n")
+		fmt.Fprintf(fs.Output(), "Waits until an email matching -query is stored and prints it as JSON.\n")
+		fmt.Fprintf(fs.Output(), "Only emails stored after the wait starts match, unless -query has an after: term.\n")
+		fmt.Fprintf(fs.Output(), "Exits 0 when one is found and 1 on timeout or error.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	// The query is checked before connecting; the wait starts once
+	// connected, so nothing stored in between is skipped
+	if _, err := parseWaitQuery(*query, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -query: %v\n", err)
+		return 2
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	var found []byte
+	var err error
+	if *apiURL != "" {
+		baseURL := strings.TrimSuffix(*apiURL, "/")
+		client := &http.Client{}
+		// Subscribe before the first search, so no message slips between them
+		changes := apiChanges(ctx, client, baseURL)
+		search, _ := parseWaitQuery(*query, time.Now())
+		skip := map[string]bool{}
+		if search.scoped {
+			var ids []string
+			ids, err = apiMatches(ctx, client, baseURL, search.query, maxPageSize)
+			for _, id := range ids {
+				skip[id] = true
+			}
+		}
+		if err == nil {
+			found, err = waitForEmail(ctx, apiFinder(client, baseURL, search.query, skip), changes, waitAPIPollInterval)
+		}
+	} else {
+		if *dbPath == "" {
+			*dbPath = GetDefaultDBPath()
+		}
+		store, storeErr := OpenStore(*dbPath, *maildir)
+		if storeErr != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", storeErr)
+			return 1
+		}
+		defer store.Close()
+		search, _ := parseWaitQuery(*query, time.Now())
+		skip := map[string]bool{}
+		if search.scoped {
+			skip, err = storeMatches(store, search.filter)
+		}
+		if err == nil {
+			found, err = waitForEmail(ctx, storeFinder(store, search.filter, skip), nil, waitDBPollInterval)
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "Timed out after %s waiting for an email matching %q\n", *timeout, *query)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Wait failed: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(found))
+	return 0
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+func TestWaitForEmailInDatabase(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "wait.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	if err := SaveEmail(db, parseEmail("Subject: Other\r\n\r\n", "app@example.com", []string{"bob@test"}, "other")); err != nil {
+		t.Fatalf("SaveEmail failed: %v", err)
+	}
+
+	filter, err := ParseFilter("to:alice@test subject:Welcome", time.Now())
+	if err != nil {
+		t.Fatalf("ParseFilter failed: %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		SaveEmail(db, parseEmail("Subject: Welcome aboard\r\n\r\n", "app@example.com", []string{"alice@test"}, "welcome"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	found, err := waitForEmail(ctx, storeFinder(NewSQLiteStore(db), filter, nil), nil, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("waitForEmail failed: %v", err)
+	}
+
+	var message mailpitMessage
+	if err := json.Unmarshal(found, &message); err != nil {
+		t.Fatalf("Failed to decode %s: %v", found, err)
+	}
+	if message.ID != "welcome" || message.Subject != "Welcome aboard" {
+		t.Errorf("Expected the welcome email, got %+v", message)
+	}
+}
+
+func TestWaitForEmailTimeout(t *testing.T) {
+	dir := t.TempDir()
+	db, err := InitDB(filepath.Join(dir, "wait.db"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	filter, _ := ParseFilter("", time.Now())
+	if _, err := waitForEmail(ctx, storeFinder(NewSQLiteStore(db), filter, nil), nil, 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-db", filepath.Join(dir, "wait.db"), "-timeout", "50ms"}, 1},
+		{[]string{"-query", "size>lots"}, 2},
+		{[]string{"unexpected"}, 2},
+	}
+	for _, tt := range tests {
+		if code := runWait(tt.args); code != tt.want {
+			t.Errorf("runWait(%q) = %d, want %d", tt.args, code, tt.want)
+		}
+	}
+}
+
+func TestWaitForEmailThroughAPI(t *testing.T) {
+	server, store := newEventsTest(t)
+	client := &http.Client{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changes := apiChanges(ctx, client, server.URL)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		store.Save(parseEmail("Subject: Invoice\r\n\r\n", "app@example.com", []string{"alice@example.com"}, "invoice"))
+	}()
+
+	// The long poll interval means only the event stream can wake the wait
+	found, err := waitForEmail(ctx, apiFinder(client, server.URL, "subject:Invoice", nil), changes, time.Hour)
+	if err != nil {
+		t.Fatalf("waitForEmail failed: %v", err)
+	}
+	var message mailpitMessage
+	if err := json.Unmarshal(found, &message); err != nil {
+		t.Fatalf("Failed to decode %s: %v", found, err)
+	}
+	if message.Subject != "Invoice" || message.ReturnPath != "app@example.com" {
+		t.Errorf("Unexpected message %+v", message)
+	}
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid filter", http.StatusBadRequest)
+	}))
+	defer bad.Close()
+	if _, err := waitForEmail(ctx, apiFinder(client, bad.URL, "size>lots", nil), nil, time.Hour); err == nil || !strings.Contains(err.Error(), "invalid filter") {
+		t.Errorf("Expected the API error to be reported, got %v", err)
+	}
+}
+
+func TestWaitQuery(t *testing.T) {
+	start := time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query, want string
+		scoped      bool
+	}{
+		{"", "after:2026-01-31T12:00:00Z", true},
+		{"subject:Welcome", "subject:Welcome after:2026-01-31T12:00:00Z", true},
+		{`subject:"Welcome aboard" after:1m`, `subject:"Welcome aboard" after:2026-01-31T11:59:00Z`, false},
+		{"after:2026-01-01 before:2h", "after:2026-01-01 before:2026-01-31T10:00:00Z", false},
+		{"-after:1h", "-after:2026-01-31T11:00:00Z after:2026-01-31T12:00:00Z", true},
+	}
+	for _, tt := range tests {
+		got, scoped, err := waitQuery(tt.query, start)
+		if err != nil || got != tt.want || scoped != tt.scoped {
+			t.Errorf("waitQuery(%q) = %q, %t, %v, want %q, %t", tt.query, got, scoped, err, tt.want, tt.scoped)
+		}
+	}
+	if _, _, err := waitQuery(`subject:"Welcome`, start); err == nil {
+		t.Error("Expected an unterminated quote to fail")
+	}
+}
+
+func TestWaitIgnoresEarlierEmails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wait.db")
+	db, err := InitDB(path)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+
+	// Left over from an earlier run
+	earlier := parseEmail("Subject: Welcome\r\n\r\n", "app@example.com", []string{"alice@test"}, "earlier")
+	earlier.CreatedAt = time.Now().Add(-10 * time.Second)
+	if err := SaveEmail(db, earlier); err != nil {
+		t.Fatalf("SaveEmail failed: %v", err)
+	}
+
+	if code := runWait([]string{"-db", path, "-query", "subject:Welcome", "-timeout", "100ms"}); code != 1 {
+		t.Errorf("Expected the earlier email to be ignored, got exit code %d", code)
+	}
+	if code := runWait([]string{"-db", path, "-query", "subject:Welcome after:1m", "-timeout", "100ms"}); code != 0 {
+		t.Errorf("Expected after:1m to include the earlier email, got exit code %d", code)
+	}
+
+	// The API resolves the same query to the same emails
+	server := httptest.NewServer(NewAPIServer(0, NewSQLiteStore(db)).Handler())
+	defer server.Close()
+	if code := runWait([]string{"-url", server.URL, "-query", "subject:Welcome", "-timeout", "100ms"}); code != 1 {
+		t.Errorf("Expected the earlier email to be ignored through the API, got exit code %d", code)
+	}
+	if code := runWait([]string{"-url", server.URL, "-query", "subject:Welcome after:1m", "-timeout", "100ms"}); code != 0 {
+		t.Errorf("Expected after:1m to include the earlier email through the API, got exit code %d", code)
+	}
+}
+
+func TestWaitIgnoresEmailsEarlierInTheSameSecond(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wait.db")
+	db, err := InitDB(path)
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	defer db.Close()
+	server := httptest.NewServer(NewAPIServer(0, NewSQLiteStore(db)).Handler())
+	defer server.Close()
+
+	// Stored at the start of a second, so the waits below start in it
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	if err := SaveEmail(db, parseEmail("Subject: Welcome\r\n\r\n", "app@example.com", []string{"alice@test"}, "earlier")); err != nil {
+		t.Fatalf("SaveEmail failed: %v", err)
+	}
+
+	if code := runWait([]string{"-db", path, "-query", "subject:Welcome", "-timeout", "100ms"}); code != 1 {
+		t.Errorf("Expected the earlier email to be ignored, got exit code %d", code)
+	}
+	if code := runWait([]string{"-url", server.URL, "-query", "subject:Welcome", "-timeout", "100ms"}); code != 1 {
+		t.Errorf("Expected the earlier email to be ignored through the API, got exit code %d", code)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		SaveEmail(db, parseEmail("Subject: Welcome\r\n\r\n", "app@example.com", []string{"alice@test"}, "later"))
+	}()
+	if code := runWait([]string{"-db", path, "-query", "subject:Welcome", "-timeout", "5s"}); code != 0 {
+		t.Errorf("Expected the later email to be found, got exit code %d", code)
+	}
+}
@@ -0,0 +1,219 @@
+// lazySMTP web UI: a client of the Mailpit compatible API that reloads
+// whenever the event stream reports a change.
+(function () {
+  "use strict";
+
+  const pageSize = 200;
+  const $ = (id) => document.getElementById(id);
+
+  let messages = [];
+  let selected = null;
+  let tab = "html";
+  let query = "";
+
+  function formatDate(value) {
+    const date = new Date(value);
+    const today = new Date();
+    if (date.toDateString() === today.toDateString()) {
+      return date.toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+    }
+    return date.toLocaleDateString();
+  }
+
+  function formatAddress(address) {
+    if (!address) {
+      return "";
+    }
+    return address.Name ? `${address.Name} <${address.Address}>` : address.Address;
+  }
+
+  function formatSize(bytes) {
+    if (bytes < 1024) {
+      return `${bytes} B`;
+    }
+    if (bytes < 1024 * 1024) {
+      return `${(bytes / 1024).toFixed(1)} KB`;
+    }
+    return `${(bytes / 1024 / 1024).toFixed(1)} MB`;
+  }
+
+  function element(tag, className, text) {
+    const el = document.createElement(tag);
+    if (className) {
+      el.className = className;
+    }
+    if (text !== undefined) {
+      el.textContent = text;
+    }
+    return el;
+  }
+
+  async function request(method, url, body) {
+    const options = { method };
+    if (body !== undefined) {
+      options.headers = { "Content-Type": "application/json" };
+      options.body = JSON.stringify(body);
+    }
+    const response = await fetch(url, options);
+    if (!response.ok) {
+      throw new Error((await response.text()).trim() || response.statusText);
+    }
+    return response;
+  }
+
+  async function loadMessages() {
+    const url = query
+      ? `/api/v1/search?limit=${pageSize}&query=${encodeURIComponent(query)}`
+      : `/api/v1/messages?limit=${pageSize}`;
+    try {
+      const data = await (await request("GET", url)).json();
+      $("search").classList.remove("invalid");
+      $("search").title = "";
+      messages = data.messages;
+      $("status").textContent = data.total > messages.length
+        ? `${messages.length} of ${data.total}`
+        : `${data.total} emails`;
+    } catch (err) {
+      $("search").classList.add("invalid");
+      $("search").title = err.message;
+      return;
+    }
+
+    renderList();
+    if (selected && !messages.some((m) => m.ID === selected)) {
+      showMessage(null);
+    }
+  }
+
+  function renderList() {
+    const list = $("messages");
+    list.replaceChildren(...messages.map((message) => {
+      const item = element("li", message.ID === selected ? "selected" : "");
+      item.append(
+        element("span", "date", formatDate(message.Created)),
+        element("div", "from", formatAddress(message.From)),
+        element("div", "subject", message.Subject || "(no subject)"),
+        element("div", "snippet", message.Snippet),
+      );
+      item.addEventListener("click", () => showMessage(message.ID));
+      return item;
+    }));
+  }
+
+  async function showMessage(id) {
+    selected = id;
+    renderList();
+    $("message").hidden = !id;
+    $("empty").hidden = !!id;
+    if (!id) {
+      return;
+    }
+
+    let message;
+    try {
+      message = await (await request("GET", `/api/v1/message/${encodeURIComponent(id)}`)).json();
+    } catch (err) {
+      $("status").textContent = err.message;
+      return;
+    }
+    if (selected !== id) {
+      return;
+    }
+
+    $("subject").textContent = message.Subject || "(no subject)";
+    const rows = [
+      ["From", formatAddress(message.From)],
+      ["To", message.To.map(formatAddress).join(", ")],
+      ["Cc", message.Cc.map(formatAddress).join(", ")],
+      ["Bcc", message.Bcc.map(formatAddress).join(", ")],
+      ["Date", new Date(message.Date).toLocaleString()],
+      ["Size", formatSize(message.Size)],
+    ];
+    $("summary").replaceChildren(...rows.filter((row) => row[1]).map(([name, value]) => {
+      const tr = element("tr");
+      tr.append(element("th", "", name), element("td", "", value));
+      return tr;
+    }));
+
+    $("attachments").replaceChildren(...message.Attachments.map((attachment) => {
+      const item = element("li");
+      const link = element("a", "", `📎 ${attachment.FileName || "attachment"} (${formatSize(attachment.Size)})`);
+      link.href = `/api/v1/message/${encodeURIComponent(id)}/part/${attachment.PartID}`;
+      item.append(link);
+      return item;
+    }));
+
+    $("text").textContent = message.Text;
+    $("html").src = `/view/${encodeURIComponent(id)}/html`;
+    $("headers").replaceChildren();
+    $("raw").textContent = "";
+    showTab(tab);
+  }
+
+  async function showTab(name) {
+    tab = name;
+    for (const button of $("tabs").querySelectorAll("button")) {
+      button.classList.toggle("active", button.dataset.tab === name);
+      $(button.dataset.tab).hidden = button.dataset.tab !== name;
+    }
+
+    const id = selected;
+    try {
+      if (name === "headers" && !$("headers").hasChildNodes()) {
+        const headers = await (await request("GET", `/api/v1/message/${encodeURIComponent(id)}/headers`)).json();
+        if (selected !== id) {
+          return;
+        }
+        $("headers").replaceChildren(...Object.keys(headers).sort().flatMap((name) => headers[name].map((value) => {
+          const tr = element("tr");
+          tr.append(element("th", "", name), element("td", "", value));
+          return tr;
+        })));
+      } else if (name === "raw" && !$("raw").textContent) {
+        const raw = await (await request("GET", `/api/v1/message/${encodeURIComponent(id)}/raw`)).text();
+        if (selected === id) {
+          $("raw").textContent = raw;
+        }
+      }
+    } catch (err) {
+      $("status").textContent = err.message;
+    }
+  }
+
+  async function deleteMessages(ids) {
+    try {
+      await request("DELETE", "/api/v1/messages", ids ? { IDs: ids } : undefined);
+    } catch (err) {
+      $("status").textContent = err.message;
+    }
+    // The resulting delete or clear event reloads the list
+  }
+
+  let searchTimer;
+  $("search").addEventListener("input", (event) => {
+    clearTimeout(searchTimer);
+    searchTimer = setTimeout(() => {
+      query = event.target.value.trim();
+      loadMessages();
+    }, 200);
+  });
+
+  $("delete").addEventListener("click", () => deleteMessages([selected]));
+  $("delete-all").addEventListener("click", () => {
+    if (confirm("Delete all emails?")) {
+      deleteMessages();
+    }
+  });
+  for (const button of $("tabs").querySelectorAll("button")) {
+    button.addEventListener("click", () => showTab(button.dataset.tab));
+  }
+
+  const events = new EventSource("/api/events");
+  for (const type of ["message", "delete", "clear"]) {
+    events.addEventListener(type, loadMessages);
+  }
+  // Catch up on anything missed while the stream was reconnecting
+  events.addEventListener("open", loadMessages);
+
+  loadMessages();
+})();
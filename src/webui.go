@@ -0,0 +1,37 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"net/url"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// registerWebUI adds the single-page web UI to mux. It is a static client of
+// the Mailpit API and the event stream, plus the pages it needs.
+func (a *APIServer) registerWebUI(mux *http.ServeMux) {
+	static, _ := fs.Sub(webFiles, "web")
+	mux.Handle("GET /{$}", http.FileServerFS(static))
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(static)))
+	mux.HandleFunc("GET /view/{id}/html", a.handleView)
+	mux.HandleFunc("GET /view/{id}/cid/{cid}", a.handleViewInline)
+}
+
+func (a *APIServer) handleView(w http.ResponseWriter, r *http.Request) {
+	email, ok := a.lookupEmail(w, r)
+	if !ok {
+		return
+	}
+	writePreview(w, *email, "/view/"+url.PathEscape(email.ID)+"/cid/", a.blockRemote)
+}
+
+func (a *APIServer) handleViewInline(w http.ResponseWriter, r *http.Request) {
+	email, ok := a.lookupEmail(w, r)
+	if !ok {
+		return
+	}
+	writeInlinePart(w, r, *email, r.PathValue("cid"))
+}
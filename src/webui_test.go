@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWebUIServesEmbeddedFiles(t *testing.T) {
+	server := newTestAPI(t)
+
+	for _, path := range []string{"/", "/static/app.js", "/static/style.css"} {
+		resp := apiRequest(t, "GET", server.URL+path, nil)
+		if resp.StatusCode != 200 {
+			t.Errorf("GET %s: expected 200, got %d", path, resp.StatusCode)
+		}
+	}
+
+	body, _ := io.ReadAll(apiRequest(t, "GET", server.URL+"/", nil).Body)
+	if !strings.Contains(string(body), `<script src="/static/app.js">`) {
+		t.Errorf("Expected the index page, got %q", body)
+	}
+}
+
+func TestWebUIViewRewritesInlineImages(t *testing.T) {
+	server := newTestAPI(t, inlineImageEmail)
+
+	resp := apiRequest(t, "GET", server.URL+"/view/a/html", nil)
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `src="/view/a/cid/logo@example.com"`) {
+		t.Errorf("Expected the cid: reference to be rewritten, got %q", body)
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'none'") || !strings.Contains(csp, "sandbox") {
+		t.Errorf("Expected the message sandboxed without scripts, got %q", csp)
+	}
+
+	resp = apiRequest(t, "GET", server.URL+"/view/a/cid/logo@example.com", nil)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Expected the inline image, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("X-Content-Type-Options") != "nosniff" || resp.Header.Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("Expected the inline part sandboxed and not sniffed, got %v", resp.Header)
+	}
+
+	index, _ := io.ReadAll(apiRequest(t, "GET", server.URL+"/", nil).Body)
+	if strings.Contains(string(index), "allow-same-origin") {
+		t.Error("Expected the message frame not to share the web UI's origin")
+	}
+
+	if resp := apiRequest(t, "GET", server.URL+"/view/missing/html", nil); resp.StatusCode != 404 {
+		t.Errorf("Expected 404 for an unknown message, got %d", resp.StatusCode)
+	}
+}
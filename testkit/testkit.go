@@ -0,0 +1,110 @@
+// Package testkit runs lazySMTP's SMTP server inside a Go test, so code that
+// sends email can be checked end to end without a mail server:
+//
+//	func TestSignup(t *testing.T) {
+//		mail := testkit.Start(t)
+//		app := NewApp(mail.Addr)
+//
+//		app.Signup("alice@example.com")
+//
+//		email := mail.WaitForMessage(t, 5*time.Second)
+//		testkit.AssertSentTo(t, email, "alice@example.com")
+//		testkit.AssertSubjectContains(t, email, "Welcome")
+//	}
+package testkit
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mouayed/lazysmtp/smtpd"
+)
+
+// Server is an SMTP server capturing every message into Store. It accepts
+// any sender, recipient and login.
+type Server struct {
+	// Addr is the host:port to send mail to.
+	Addr string
+	// Store holds the received messages, oldest first.
+	Store *smtpd.CaptureStore
+
+	updates *smtpd.Subscription
+	next    int
+}
+
+// Start listens on a free loopback port and stops the server when the test
+// ends.
+func Start(t testing.TB) *Server {
+	t.Helper()
+	store := smtpd.NewCaptureStore()
+	updates := store.Subscribe()
+
+	server := smtpd.NewServer(0, store)
+	server.SetHost("127.0.0.1")
+	if err := server.Start(); err != nil {
+		updates.Close()
+		t.Fatalf("testkit: failed to start SMTP server: %v", err)
+	}
+	s := &Server{
+		Addr:    server.Addr(),
+		Store:   store,
+		updates: updates,
+	}
+	t.Cleanup(func() {
+		server.Stop()
+		s.updates.Close()
+	})
+	return s
+}
+
+// WaitForMessage returns the oldest message not yet returned by an earlier
+// call, waiting up to timeout for it to arrive. It fails the test on
+// timeout.
+func (s *Server) WaitForMessage(t testing.TB, timeout time.Duration) smtpd.Email {
+	t.Helper()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		if emails := s.Store.Emails(); len(emails) > s.next {
+			s.next++
+			return emails[s.next-1]
+		}
+		select {
+		case _, ok := <-s.updates.Events:
+			if !ok {
+				// Dropped for falling behind; the store is checked again
+				s.updates = s.Store.Subscribe()
+			}
+		case <-deadline.C:
+			t.Fatalf("testkit: no message received within %s", timeout)
+			return smtpd.Email{}
+		}
+	}
+}
+
+// AssertSentTo reports whether address is one of the envelope recipients of
+// email, failing the test if not. Addresses are compared case-insensitively.
+func AssertSentTo(t testing.TB, email smtpd.Email, address string) bool {
+	t.Helper()
+	recipients := smtpd.RecipientAddresses(email.Recipients)
+	for _, rcpt := range recipients {
+		if strings.EqualFold(rcpt, address) {
+			return true
+		}
+	}
+	t.Errorf("testkit: message %q was not sent to %s; recipients: %s", email.Subject, address, strings.Join(recipients, ", "))
+	return false
+}
+
+// AssertSubjectContains reports whether the decoded subject of email
+// contains substr, failing the test if not.
+func AssertSubjectContains(t testing.TB, email smtpd.Email, substr string) bool {
+	t.Helper()
+	if strings.Contains(email.Subject, substr) {
+		return true
+	}
+	t.Errorf("testkit: subject %q does not contain %q", email.Subject, substr)
+	return false
+}
@@ -0,0 +1,71 @@
+package testkit
+
+import (
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+func send(addr, to, subject string) error {
+	msg := "From: app@example.com\r\nTo: " + to + "\r\nSubject: " + subject + "\r\n\r\nHello\r\n"
+	return smtp.SendMail(addr, nil, "app@example.com", []string{to}, []byte(msg))
+}
+
+// recorder collects assertion failures instead of failing the test.
+type recorder struct {
+	testing.TB
+	failures int
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.failures++
+}
+
+func TestStartCapturesMessages(t *testing.T) {
+	mail := Start(t)
+
+	if err := send(mail.Addr, "alice@example.com", "Welcome aboard"); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	sent := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sent <- send(mail.Addr, "Bob@Example.com", "Your invoice")
+	}()
+
+	first := mail.WaitForMessage(t, 5*time.Second)
+	AssertSentTo(t, first, "alice@example.com")
+	AssertSubjectContains(t, first, "Welcome")
+
+	second := mail.WaitForMessage(t, 5*time.Second)
+	AssertSentTo(t, second, "bob@example.com")
+	AssertSubjectContains(t, second, "invoice")
+	if err := <-sent; err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+
+	if emails := mail.Store.Emails(); len(emails) != 2 {
+		t.Errorf("Expected 2 stored messages, got %d", len(emails))
+	}
+}
+
+func TestAssertionsReportFailures(t *testing.T) {
+	mail := Start(t)
+	if err := send(mail.Addr, "alice@example.com", "Welcome aboard"); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	email := mail.WaitForMessage(t, 5*time.Second)
+
+	probe := &recorder{TB: t}
+	if AssertSentTo(probe, email, "bob@example.com") {
+		t.Error("Expected AssertSentTo to fail for another recipient")
+	}
+	if AssertSubjectContains(probe, email, "Invoice") {
+		t.Error("Expected AssertSubjectContains to fail for another subject")
+	}
+	if probe.failures != 2 {
+		t.Errorf("Expected 2 reported failures, got %d", probe.failures)
+	}
+}